@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// previous versions of a secret are kept in a history secret next to it
+const (
+	historySuffix     = ".kubesops-history"
+	historySecretType = "kubesops.vafer.org/history"
+	historyLabel      = "kubesops.vafer.org/history-of"
+	historyMaxEntries = 10
+
+	// reads and writes of the history secret when backups of a secret run concurrently
+	historyWriteAttempts = 5
+)
+
+// represents one saved version of a secret
+type BackupEntry struct {
+	Version int            `json:"version"`
+	SavedAt time.Time      `json:"savedAt"`
+	Secret  *corev1.Secret `json:"secret"`
+}
+
+// historySecretName returns the name of the history secret for a secret
+func historySecretName(secretName string) string {
+	return secretName + historySuffix
+}
+
+// backupSecret saves the live state of a secret as a new version in its history secret
+// only the newest historyMaxEntries versions are kept
+// the history secret is only overwritten in the version that was read, concurrent backups are retried
+func (k *kubeClient) backupSecret(ctx context.Context, namespace string, live *corev1.Secret) (int, error) {
+	for attempt := 1; ; attempt++ {
+		version, err := k.tryBackupSecret(ctx, namespace, live)
+		if err == nil || !isRemoteChanged(err) || attempt >= historyWriteAttempts {
+			return version, err
+		}
+	}
+}
+
+// tryBackupSecret reads the history secret once and writes it with the new version
+// returns errRemoteChanged if the history secret was changed or created since it was read
+func (k *kubeClient) tryBackupSecret(ctx context.Context, namespace string, live *corev1.Secret) (int, error) {
+	history, err := k.getSecret(ctx, namespace, historySecretName(live.Name))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return 0, err
+	}
+
+	entries, err := historyEntries(history)
+	if err != nil {
+		return 0, err
+	}
+
+	version := 1
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		// this exact state is saved already
+		if last.Secret != nil && last.Secret.ResourceVersion == live.ResourceVersion {
+			return last.Version, nil
+		}
+		version = last.Version + 1
+	}
+
+	// keep what is needed to restore the secret
+	saved := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            live.Name,
+			Namespace:       live.Namespace,
+			Labels:          live.Labels,
+			Annotations:     live.Annotations,
+			OwnerReferences: live.OwnerReferences,
+			ResourceVersion: live.ResourceVersion,
+		},
+		Type: live.Type,
+		Data: live.Data,
+	}
+	entries = append(entries, BackupEntry{Version: version, SavedAt: time.Now().UTC(), Secret: saved})
+
+	if len(entries) > historyMaxEntries {
+		entries = entries[len(entries)-historyMaxEntries:]
+	}
+
+	historyData := make(map[string][]byte)
+	for _, entry := range entries {
+		content, err := json.Marshal(entry)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding backup: %w", err)
+		}
+		historyData[historyKey(entry.Version)] = content
+	}
+
+	remoteNamespace := k.namespace(namespace)
+	secrets := k.clientset.CoreV1().Secrets(remoteNamespace)
+
+	historyName := historySecretName(live.Name)
+	err = k.doWrite(ctx, func(ctx context.Context) error {
+		var err error
+		if history == nil {
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      historyName,
+					Namespace: remoteNamespace,
+					Labels:    map[string]string{historyLabel: live.Name},
+				},
+				Type: historySecretType,
+				Data: historyData,
+			}, metav1.CreateOptions{FieldManager: fieldManager})
+			return err
+		}
+		// the resourceVersion of the read history secret guards the update
+		updated := history.DeepCopy()
+		updated.ManagedFields = nil
+		updated.Data = historyData
+		_, err = secrets.Update(ctx, updated, metav1.UpdateOptions{FieldManager: fieldManager})
+		return err
+	}, func(ctx context.Context) (bool, error) {
+		current, err := secrets.Get(ctx, historyName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return maps.EqualFunc(current.Data, historyData, bytes.Equal), nil
+	})
+	if err != nil {
+		return 0, writeError("backup", err)
+	}
+
+	return version, nil
+}
+
+// saveBackup saves the live state of a secret to its history and reports the version
+func (k *kubeClient) saveBackup(ctx context.Context, namespace string, live *corev1.Secret) error {
+	version, err := k.backupSecret(ctx, namespace, live)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved secret %s in namespace %s as version %d\n", live.Name, k.namespace(namespace), version)
+
+	return nil
+}
+
+// secretHistory returns the saved versions of a secret, oldest first
+func (k *kubeClient) secretHistory(ctx context.Context, namespace, secretName string) ([]BackupEntry, error) {
+	history, err := k.getSecret(ctx, namespace, historySecretName(secretName))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return historyEntries(history)
+}
+
+// historyEntries decodes the saved versions of a history secret, oldest first
+// a missing history secret (nil) has no versions
+func historyEntries(history *corev1.Secret) ([]BackupEntry, error) {
+	if history == nil {
+		return nil, nil
+	}
+
+	var entries []BackupEntry
+	for key, content := range history.Data {
+		if !strings.HasPrefix(key, "v") {
+			continue
+		}
+		var entry BackupEntry
+		if err := json.Unmarshal(content, &entry); err != nil {
+			return nil, fmt.Errorf("error decoding backup %s of %s: %w", key, strings.TrimSuffix(history.Name, historySuffix), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Version < entries[j].Version
+	})
+
+	return entries, nil
+}
+
+// historyKey returns the data key of a version in the history secret
+func historyKey(version int) string {
+	return "v" + strconv.Itoa(version)
+}
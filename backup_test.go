@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestBackupRetriesConcurrentHistoryWrites(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	ctx := context.Background()
+
+	live := testSecret("test", "app", map[string]string{"PASSWORD": "v1"})
+	if _, err := kube.backupSecret(ctx, "test", live); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	// another backup of the same secret updates the history secret first
+	conflicts := 0
+	clientset.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.UpdateAction).GetObject().(*corev1.Secret)
+		if secret.Name == historySecretName("app") && conflicts == 0 {
+			conflicts++
+			return true, nil, apierrors.NewConflict(corev1.Resource("secrets"), secret.Name, errors.New("modified"))
+		}
+		return false, nil, nil
+	})
+
+	live = testSecret("test", "app", map[string]string{"PASSWORD": "v2"})
+	live.ResourceVersion = "2"
+	version, err := kube.backupSecret(ctx, "test", live)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	history, err := kube.secretHistory(ctx, "test", "app")
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if conflicts != 1 || version != 2 || len(history) != 2 || string(history[1].Secret.Data["PASSWORD"]) != "v2" {
+		t.Errorf("expected version 2 after a retried conflict, got %d of %d (conflicts %d)", version, len(history), conflicts)
+	}
+}
+
+func TestRollbackRequiresAdoptAndRecreate(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	ctx := context.Background()
+
+	saved := testSecret("test", "app", map[string]string{"PASSWORD": "v1"})
+	saved.Labels = map[string]string{managedByLabel: managedByValue}
+	if _, err := kube.backupSecret(ctx, "test", saved); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	// since then someone else took the secret over and changed its type
+	current := testSecret("test", "app", map[string]string{"username": "admin"})
+	current.Type = corev1.SecretTypeBasicAuth
+	if _, err := clientset.CoreV1().Secrets("test").Create(ctx, current, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{{Doit: true}, {Doit: true, Adopt: true}} {
+		if err := handleRollback(ctx, kube, "test/app", 0, opts); err == nil {
+			t.Errorf("expected rollback to fail with %+v", opts)
+		}
+	}
+	if secret := getTestSecret(t, clientset, "test", "app"); secret.Type != corev1.SecretTypeBasicAuth {
+		t.Fatalf("expected the secret to be left alone, got %s", secret.Type)
+	}
+
+	if err := handleRollback(ctx, kube, "test/app", 0, Options{Doit: true, Adopt: true, Recreate: true}); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	secret := getTestSecret(t, clientset, "test", "app")
+	if secret.Type != corev1.SecretTypeOpaque || string(secret.Data["PASSWORD"]) != "v1" {
+		t.Errorf("expected version 1 to be restored, got %s %v", secret.Type, secretStringData(secret))
+	}
+}
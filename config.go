@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPath is read if present, a missing file is not an error
+const defaultConfigPath = ".kubesops.yaml"
+
+// represents the optional kubesops configuration file
+type Config struct {
+	KeyCommand       string            `yaml:"key_command"`       // shell command printing the age identity
+	KeyFile          string            `yaml:"key_file"`          // file holding the age identity
+	CreateNamespaces bool              `yaml:"create_namespaces"` // create missing namespaces on upload
+	NamespaceLabels  map[string]string `yaml:"namespace_labels"`  // labels for created namespaces
+}
+
+// loadConfig reads the configuration file at path
+// a missing file at the default location yields an empty config
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == defaultConfigPath {
+			return config, nil
+		}
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	if config.KeyCommand != "" && config.KeyFile != "" {
+		return nil, fmt.Errorf("invalid config %s: key_command and key_file are exclusive", path)
+	}
+
+	return config, nil
+}
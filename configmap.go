@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// configMapAsSecret returns a secret with the metadata and data of a ConfigMap
+// so diffs, ownership checks and hashes treat both kinds the same way, the type stays empty
+// binaryData keys are data keys like any other
+func configMapAsSecret(configMap *corev1.ConfigMap) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: configMap.ObjectMeta,
+		Data:       make(map[string][]byte),
+	}
+	for key, value := range configMap.Data {
+		secret.Data[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		secret.Data[key] = value
+	}
+	return secret
+}
+
+// getRemote reads the remote object of a local file, ConfigMaps are returned as secrets
+func getRemote(ctx context.Context, kube Kube, secret *Secret) (*corev1.Secret, error) {
+	if !secret.IsConfigMap() {
+		return kube.getSecret(ctx, secret.Namespace, secret.Name)
+	}
+
+	configMap, err := kube.getConfigMap(ctx, secret.Namespace, secret.Name)
+	if err != nil {
+		return nil, err
+	}
+	return configMapAsSecret(configMap), nil
+}
+
+// getConfigMap reads a ConfigMap from Kubernetes
+func (k *kubeClient) getConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	var configMap *corev1.ConfigMap
+	err := k.do(ctx, func(ctx context.Context) error {
+		var err error
+		configMap, err = k.clientset.CoreV1().ConfigMaps(k.namespace(namespace)).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading configmap: %w", err)
+	}
+
+	return configMap, nil
+}
+
+// listConfigMaps lists the ConfigMaps in a namespace matching labelSelector
+func (k *kubeClient) listConfigMaps(ctx context.Context, namespace, labelSelector string) ([]corev1.ConfigMap, error) {
+	var list *corev1.ConfigMapList
+	err := k.do(ctx, func(ctx context.Context) error {
+		var err error
+		list, err = k.clientset.CoreV1().ConfigMaps(k.namespace(namespace)).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing configmaps: %w", err)
+	}
+
+	return list.Items, nil
+}
+
+// configMapWrite writes a ConfigMap using server-side apply, the same way secretWrite writes secrets
+// values that are not valid UTF-8 are applied as binaryData
+// ConfigMaps are not saved to the history
+func (k *kubeClient) configMapWrite(ctx context.Context, namespace, name string, values map[string]string, meta managedMeta, live *corev1.ConfigMap) error {
+	configMap := corev1ac.ConfigMap(name, k.namespace(namespace)).
+		WithLabels(meta.Labels).
+		WithAnnotations(meta.Annotations)
+
+	data := make(map[string]string)
+	binaryData := make(map[string][]byte)
+	for key, value := range values {
+		if utf8.ValidString(value) {
+			data[key] = value
+		} else {
+			binaryData[key] = []byte(value)
+		}
+	}
+	configMap.WithData(data)
+	if len(binaryData) > 0 {
+		configMap.WithBinaryData(binaryData)
+	}
+
+	// only overwrite the version that was diffed
+	if live != nil {
+		configMap.WithResourceVersion(live.ResourceVersion)
+	}
+
+	configMaps := k.clientset.CoreV1().ConfigMaps(*configMap.Namespace)
+	var applied *corev1.ConfigMap
+	err := k.doWrite(ctx, func(ctx context.Context) error {
+		var err error
+		applied, err = configMaps.Apply(ctx, configMap, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        k.forceConflicts,
+		})
+		return err
+	}, func(ctx context.Context) (bool, error) {
+		current, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		applied = current
+		return hasValues(current.ObjectMeta, secretStringData(configMapAsSecret(current)), values, meta), nil
+	})
+	if err != nil {
+		return applyError("configmap", err)
+	}
+	fmt.Printf("Applied configmap %s in namespace %s\n", name, applied.Namespace)
+
+	if live != nil {
+		printRemovedKeys("configmap", name, applied.Namespace, secretStringData(configMapAsSecret(live)), secretStringData(configMapAsSecret(applied)), values)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// systemSecret reports whether a remote secret belongs to the cluster or another tool
+// that is whatever secretManager knows a manager of other than kubesops
+func systemSecret(secret *corev1.Secret) bool {
+	return !isManaged(secret) && secretManager(secret) != ""
+}
+
+// secretFilter selects secrets by name, type and labels
+// each given criterion must match, within a criterion any value may match
+type secretFilter struct {
+	names    []string        // globs on the name
+	types    []string        // full Kubernetes types
+	selector labels.Selector // nil if no selector was given
+}
+
+// newSecretFilter creates the filter for the -name, -type and -selector options
+func newSecretFilter(opts Options) (*secretFilter, error) {
+	filter := &secretFilter{names: opts.Names}
+
+	for _, name := range opts.Names {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("invalid -name pattern %q: %w", name, err)
+		}
+	}
+
+	for _, secretType := range opts.Types {
+		filter.types = append(filter.types, mapSecretType(secretType))
+	}
+
+	if opts.Selector != "" {
+		selector, err := labels.Parse(opts.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -selector %q: %w", opts.Selector, err)
+		}
+		filter.selector = selector
+	}
+
+	return filter, nil
+}
+
+// active reports whether any filter was given
+func (f *secretFilter) active() bool {
+	return len(f.names) > 0 || len(f.types) > 0 || f.selector != nil
+}
+
+// selectorString returns the label selector for list requests, empty if none was given
+func (f *secretFilter) selectorString() string {
+	if f.selector == nil {
+		return ""
+	}
+	return f.selector.String()
+}
+
+// matches reports whether a secret with name and type passes the name and type filters
+func (f *secretFilter) matches(name, secretType string) bool {
+	if len(f.names) > 0 {
+		found := false
+		for _, pattern := range f.names {
+			if ok, _ := path.Match(pattern, name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.types) > 0 {
+		found := false
+		for _, t := range f.types {
+			if t == secretType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesLabels reports whether a remote secret passes the selector
+// a missing remote secret (nil) only passes if there is no selector
+func (f *secretFilter) matchesLabels(remote *corev1.Secret) bool {
+	if f.selector == nil {
+		return true
+	}
+	return remote != nil && f.selector.Matches(labels.Set(remote.Labels))
+}
+
+// matchesRemote reports whether a remote secret passes all filters
+func (f *secretFilter) matchesRemote(remote *corev1.Secret) bool {
+	return f.matches(remote.Name, string(remote.Type)) && f.matchesLabels(remote)
+}
+
+// selectLocal returns the local secrets passing the name and type filters
+func (f *secretFilter) selectLocal(secrets []*Secret) []*Secret {
+	var selected []*Secret
+	for _, secret := range secrets {
+		if f.matches(secret.Name, secret.Type) {
+			selected = append(selected, secret)
+		}
+	}
+	return selected
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
 )
@@ -8,24 +9,27 @@ import (
 // handleDiff compares secrets
 // if path2 is empty: compare local (path1) vs remote
 // if path2 is provided: compare local (path1) vs local (path2)
-func handleDiff(path1, path2 string, verbose bool) error {
+func handleDiff(ctx context.Context, kube Kube, path1, path2 string, opts Options) error {
 	if path2 == "" {
 		// local vs remote comparison
-		return upload(path1, false, false, verbose)
+		opts.Force = false
+		opts.Doit = false
+		_, err := upload(ctx, kube, path1, opts)
+		return err
 	}
 	// local vs local comparison
-	return diffLocalVsLocal(path1, path2, verbose)
+	return diffLocalVsLocal(path1, path2, opts.Verbose, opts.Jobs)
 }
 
 // diffLocalVsLocal compares two local secrets
-func diffLocalVsLocal(path1, path2 string, verbose bool) error {
+func diffLocalVsLocal(path1, path2 string, verbose bool, jobs int) error {
 
-	secrets1, err := LoadSecretsFromPath(path1)
+	secrets1, err := LoadSecretsFromPath(path1, jobs)
 	if err != nil {
 		return fmt.Errorf("failed to load secrets from %s: %w", path1, err)
 	}
 
-	secrets2, err := LoadSecretsFromPath(path2)
+	secrets2, err := LoadSecretsFromPath(path2, jobs)
 	if err != nil {
 		return fmt.Errorf("failed to load secrets from %s: %w", path2, err)
 	}
@@ -36,7 +40,7 @@ func diffLocalVsLocal(path1, path2 string, verbose bool) error {
 		s1 := secrets1[0]
 		s2 := secrets2[0]
 
-		differences := compareSecretsLocal(s1.Namespace, s2.Namespace, s1.Data, s2.Data, verbose)
+		differences := compareSecretsLocal(s1.Namespace, s2.Namespace, s1.Data, s2.Data, commonPlaintext(s1, s2), verbose)
 		fmt.Printf("%d difference(s)\n", differences)
 
 		return nil
@@ -88,7 +92,7 @@ func diffLocalVsLocal(path1, path2 string, verbose bool) error {
 			continue
 		}
 
-		differences := compareSecretsLocal(s1.Namespace, s2.Namespace, s1.Data, s2.Data, verbose)
+		differences := compareSecretsLocal(s1.Namespace, s2.Namespace, s1.Data, s2.Data, commonPlaintext(s1, s2), verbose)
 		totalDifferences += differences
 	}
 
@@ -106,19 +110,31 @@ func truncateValue(s string, maxLen int) string {
 }
 
 // formatValue formats a value for display, with optional truncation
-func formatValue(val string, exists bool, verbose bool) string {
+// plaintext values are not sensitive and always shown in full
+func formatValue(val string, exists bool, plaintext bool, verbose bool) string {
 	if !exists {
 		return "missing"
 	}
-	if verbose {
+	if verbose || plaintext {
 		return "[" + val + "]"
 	}
 	return "[" + truncateValue(val, 10) + "]"
 }
 
+// commonPlaintext returns the keys that are unencrypted in both secrets
+func commonPlaintext(s1, s2 *Secret) map[string]bool {
+	plaintext := make(map[string]bool)
+	for key := range s1.Plaintext {
+		if s2.Plaintext[key] {
+			plaintext[key] = true
+		}
+	}
+	return plaintext
+}
+
 // compareSecretsLocal compares two local secrets and prints differences
 // returns the number of differences found
-func compareSecretsLocal(ns1, ns2 string, data1, data2 map[string]string, verbose bool) int {
+func compareSecretsLocal(ns1, ns2 string, data1, data2 map[string]string, plaintext map[string]bool, verbose bool) int {
 	differences := 0
 
 	// get all unique keys
@@ -148,8 +164,8 @@ func compareSecretsLocal(ns1, ns2 string, data1, data2 map[string]string, verbos
 		// only show values if there's a difference
 		if !exists1 || !exists2 || (val1 != val2) {
 			differences++
-			fmt.Printf("  %s: %s\n", ns1, formatValue(val1, exists1, verbose))
-			fmt.Printf("  %s: %s\n", ns2, formatValue(val2, exists2, verbose))
+			fmt.Printf("  %s: %s\n", ns1, formatValue(val1, exists1, plaintext[key], verbose))
+			fmt.Printf("  %s: %s\n", ns2, formatValue(val2, exists2, plaintext[key], verbose))
 		}
 	}
 
@@ -158,7 +174,7 @@ func compareSecretsLocal(ns1, ns2 string, data1, data2 map[string]string, verbos
 
 // compareSecretsRemote compares local vs remote secrets and prints differences
 // returns the number of differences found
-func compareSecretsRemote(secretName string, onsite, remote map[string]string, verbose bool) int {
+func compareSecretsRemote(secretName string, onsite, remote map[string]string, plaintext map[string]bool, verbose bool) int {
 	differences := 0
 
 	// get all unique keys
@@ -191,8 +207,8 @@ func compareSecretsRemote(secretName string, onsite, remote map[string]string, v
 		// only show values if there's a difference
 		if changed {
 			differences++
-			fmt.Printf("  remote: %s\n", formatValue(remoteVal, remoteExists, verbose))
-			fmt.Printf("  onsite: %s\n", formatValue(onsiteVal, onsiteExists, verbose))
+			fmt.Printf("  remote: %s\n", formatValue(remoteVal, remoteExists, plaintext[key], verbose))
+			fmt.Printf("  onsite: %s\n", formatValue(onsiteVal, onsiteExists, plaintext[key], verbose))
 		}
 	}
 
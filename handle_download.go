@@ -6,38 +6,39 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 )
 
 // handleDownload downloads secrets from Kubernetes and writes them to local files
-func handleDownload(path string) error {
+func handleDownload(ctx context.Context, kube Kube, path string, opts Options) error {
+	filter, err := newSecretFilter(opts)
+	if err != nil {
+		return err
+	}
+
 	// Check if path exists
 	info, err := os.Stat(path)
 
 	if err == nil && info.IsDir() {
 		// directory exists - download all secrets in it
-		return downloadDirectory(path)
+		return downloadDirectory(ctx, kube, path, opts.Jobs, filter)
 	} else if err == nil && !info.IsDir() {
 		// file exists - download just that one
-		return downloadFile(path)
+		return downloadFile(ctx, kube, path)
 	} else if os.IsNotExist(err) {
 		// path doesn't exist - infer from path structure
 		if strings.HasSuffix(path, ".env") {
 			// looks like a file path - download single secret
-			return downloadFile(path)
+			return downloadFile(ctx, kube, path)
 		}
 		// looks like a directory - download all in namespace
-		return downloadDirectory(path)
+		return downloadDirectory(ctx, kube, path, opts.Jobs, filter)
 	}
 
 	return fmt.Errorf("failed to access path %s: %w", path, err)
 }
 
 // downloadFile downloads a single secret based on file path
-func downloadFile(filePath string) error {
+func downloadFile(ctx context.Context, kube Kube, filePath string) error {
 	// parse namespace and secret name from path
 	// namespace is the parent directory, secret name is the filename
 	parts := strings.Split(filepath.Clean(filePath), string(filepath.Separator))
@@ -46,25 +47,29 @@ func downloadFile(filePath string) error {
 	}
 
 	namespace := parts[len(parts)-2]
-	secretNameWithExt := parts[len(parts)-1]
-	secretName := strings.TrimSuffix(secretNameWithExt, filepath.Ext(secretNameWithExt))
+	secretName, kind := nameAndKind(parts[len(parts)-1])
+
+	// an existing file may declare the kind in its header
+	if content, err := os.ReadFile(filePath); err == nil {
+		if headerKind := extractKind(string(content)); headerKind != "" {
+			kind = headerKind
+		}
+	}
+
+	if kind == kindConfigMap {
+		return downloadConfigMap(ctx, kube, namespace, secretName, filePath)
+	}
 
 	fmt.Printf("Downloading secret %s/%s...\n", namespace, secretName)
 
 	// read from Kubernetes
-	k8sData, err := secretRead(namespace, secretName)
+	secret, err := kube.getSecret(ctx, namespace, secretName)
 	if err != nil {
 		return fmt.Errorf("failed to read secret %s/%s: %w", namespace, secretName, err)
 	}
 
-	// get secret to determine type
-	secret, err := getSecretMetadata(namespace, secretName)
-	if err != nil {
-		return fmt.Errorf("failed to get secret metadata %s/%s: %w", namespace, secretName, err)
-	}
-
 	// convert from Kubernetes format back to file format
-	fileData, err := FromKubernetesData(string(secret.Type), k8sData)
+	fileData, err := FromKubernetesData(string(secret.Type), secretStringData(secret))
 	if err != nil {
 		return fmt.Errorf("failed to convert secret %s/%s: %w", namespace, secretName, err)
 	}
@@ -78,10 +83,29 @@ func downloadFile(filePath string) error {
 	return nil
 }
 
-// downloads all secrets from a directory/namespace
-func downloadDirectory(dirPath string) error {
+// downloadConfigMap downloads a ConfigMap to filePath
+func downloadConfigMap(ctx context.Context, kube Kube, namespace, name, filePath string) error {
+	fmt.Printf("Downloading configmap %s/%s...\n", namespace, name)
+
+	configMap, err := kube.getConfigMap(ctx, namespace, name)
+	if err != nil {
+		return fmt.Errorf("failed to read configmap %s/%s: %w", namespace, name, err)
+	}
+
+	// binaryData keys are written like the other keys
+	if err := WriteSecretFile(filePath, "", secretStringData(configMapAsSecret(configMap))); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+
+	fmt.Printf("Successfully downloaded %s/%s to %s\n", namespace, name, filePath)
+	return nil
+}
+
+// downloads all secrets from a directory/namespace that pass filter
+// secrets of the cluster or other tools are skipped when listing a namespace
+func downloadDirectory(ctx context.Context, kube Kube, dirPath string, jobs int, filter *secretFilter) error {
 	// try to load existing secrets first
-	secrets, err := LoadSecretsFromPath(dirPath)
+	secrets, err := LoadSecretsFromPath(dirPath, jobs)
 
 	// if no local secrets exist, try to list from Kubernetes
 	if err != nil || len(secrets) == 0 {
@@ -94,7 +118,7 @@ func downloadDirectory(dirPath string) error {
 
 		// list all secrets in namespace from Kubernetes
 		fmt.Printf("Listing secrets in namespace %s...\n", namespace)
-		k8sSecrets, err := listSecretsInNamespace(namespace)
+		k8sSecrets, err := kube.listSecrets(ctx, namespace, filter.selectorString())
 		if err != nil {
 			return fmt.Errorf("failed to list secrets in namespace %s: %w", namespace, err)
 		}
@@ -108,18 +132,32 @@ func downloadDirectory(dirPath string) error {
 
 		// download each secret from Kubernetes
 		var errors []error
+		downloaded := 0
 		for _, k8sSecret := range k8sSecrets {
+			if ctx.Err() != nil {
+				return fmt.Errorf("interrupted: %w", ctx.Err())
+			}
+
 			secretName := k8sSecret.Name
-			fmt.Printf("Downloading secret %s/%s...\n", namespace, secretName)
 
-			// read from Kubernetes
-			k8sData, err := secretRead(namespace, secretName)
-			if err != nil {
-				fmt.Printf("Warning: download failed for %s/%s: %v\n", namespace, secretName, err)
-				errors = append(errors, fmt.Errorf("%s/%s: %w", namespace, secretName, err))
+			// tokens, Helm releases, certificates and the like are not ours to keep in git
+			if systemSecret(&k8sSecret) {
+				fmt.Printf("Skipping secret %s/%s%s\n", namespace, secretName, managerSuffix(&k8sSecret))
+				continue
+			}
+			if !filter.matchesRemote(&k8sSecret) {
 				continue
 			}
 
+			if isManaged(&k8sSecret) {
+				fmt.Printf("Downloading secret %s/%s...\n", namespace, secretName)
+			} else {
+				fmt.Printf("Downloading secret %s/%s, not managed by kubesops...\n", namespace, secretName)
+			}
+
+			// the listing already contains the data
+			k8sData := secretStringData(&k8sSecret)
+
 			// convert from Kubernetes format back to file format
 			fileData, err := FromKubernetesData(string(k8sSecret.Type), k8sData)
 			if err != nil {
@@ -139,29 +177,72 @@ func downloadDirectory(dirPath string) error {
 			}
 
 			fmt.Printf("Successfully downloaded %s/%s to %s\n", namespace, secretName, filePath)
+			downloaded++
+		}
+
+		// ConfigMaps are only downloaded if kubesops uploaded them
+		configMaps, err := kube.listConfigMaps(ctx, namespace, managedByLabel+"="+managedByValue)
+		if err != nil {
+			return fmt.Errorf("failed to list configmaps in namespace %s: %w", namespace, err)
+		}
+		for _, configMap := range configMaps {
+			if ctx.Err() != nil {
+				return fmt.Errorf("interrupted: %w", ctx.Err())
+			}
+			if !filter.matchesRemote(configMapAsSecret(&configMap)) {
+				continue
+			}
+			filePath := filepath.Join("secrets", namespace, configMap.Name+configMapSuffix)
+			if err := WriteSecretFile(filePath, "", secretStringData(configMapAsSecret(&configMap))); err != nil {
+				fmt.Printf("Warning: write failed for %s/%s: %v\n", namespace, configMap.Name, err)
+				errors = append(errors, fmt.Errorf("%s/%s: %w", namespace, configMap.Name, err))
+				continue
+			}
+			fmt.Printf("Successfully downloaded configmap %s/%s to %s\n", namespace, configMap.Name, filePath)
+			downloaded++
 		}
 
 		if len(errors) > 0 {
 			fmt.Printf("\nCompleted with %d error(s)\n", len(errors))
 		} else {
-			fmt.Printf("\nSuccessfully downloaded %d secret(s)\n", len(k8sSecrets))
+			fmt.Printf("\nSuccessfully downloaded %d secret(s)\n", downloaded)
 		}
 
 		return nil
 	}
 
 	// download based on existing local files
+	secrets = filter.selectLocal(secrets)
 	var errors []error
+	downloaded := 0
 	for _, secret := range secrets {
-		fmt.Printf("Downloading secret %s/%s...\n", secret.Namespace, secret.Name)
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted: %w", ctx.Err())
+		}
+
+		if secret.IsConfigMap() {
+			if err := downloadConfigMap(ctx, kube, secret.Namespace, secret.Name, secret.Path); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				errors = append(errors, fmt.Errorf("%s/%s: %w", secret.Namespace, secret.Name, err))
+				continue
+			}
+			downloaded++
+			continue
+		}
 
 		// read from Kubernetes
-		k8sData, err := secretRead(secret.Namespace, secret.Name)
+		remote, err := kube.getSecret(ctx, secret.Namespace, secret.Name)
 		if err != nil {
 			fmt.Printf("Warning: download failed for %s/%s: %v\n", secret.Namespace, secret.Name, err)
 			errors = append(errors, fmt.Errorf("%s/%s: %w", secret.Namespace, secret.Name, err))
 			continue
 		}
+		if !filter.matchesLabels(remote) {
+			continue
+		}
+
+		fmt.Printf("Downloading secret %s/%s...\n", secret.Namespace, secret.Name)
+		k8sData := secretStringData(remote)
 
 		// convert from Kubernetes format back to file format
 		fileData, err := FromKubernetesData(secret.Type, k8sData)
@@ -182,55 +263,14 @@ func downloadDirectory(dirPath string) error {
 		}
 
 		fmt.Printf("Successfully downloaded %s/%s to %s\n", secret.Namespace, secret.Name, filePath)
+		downloaded++
 	}
 
 	if len(errors) > 0 {
 		fmt.Printf("\nCompleted with %d error(s)\n", len(errors))
 	} else {
-		fmt.Printf("\nSuccessfully downloaded %d secret(s)\n", len(secrets))
+		fmt.Printf("\nSuccessfully downloaded %d secret(s)\n", downloaded)
 	}
 
 	return nil
 }
-
-// retrieves secret metadata from Kubernetes (just type info)
-func getSecretMetadata(namespace, secretName string) (*corev1.Secret, error) {
-	config, err := getKubeConfig()
-	if err != nil {
-		return nil, fmt.Errorf("error getting Kubernetes config: %w", err)
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("error creating Kubernetes client: %w", err)
-	}
-
-	ctx := context.Background()
-	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("error reading secret: %w", err)
-	}
-
-	return secret, nil
-}
-
-// lists all secrets in a Kubernetes namespace
-func listSecretsInNamespace(namespace string) ([]corev1.Secret, error) {
-	config, err := getKubeConfig()
-	if err != nil {
-		return nil, fmt.Errorf("error getting Kubernetes config: %w", err)
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("error creating Kubernetes client: %w", err)
-	}
-
-	ctx := context.Background()
-	secretList, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("error listing secrets: %w", err)
-	}
-
-	return secretList.Items, nil
-}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"crypto/rsa"
 	"fmt"
 	"sort"
 )
 
-// prints Kubernetes secret manifests for specified path
-func handleManifest(path string) error {
+// prints Kubernetes secret and ConfigMap manifests for specified path
+// with opts.Seal secrets are printed as SealedSecrets encrypted with that sealing certificate
+func handleManifest(path string, opts Options) error {
+	var publicKey *rsa.PublicKey
+	if opts.Seal != "" {
+		if !validSealScope(opts.SealScope) {
+			return fmt.Errorf("invalid -seal-scope %s, use %s, %s or %s", opts.SealScope, sealScopeStrict, sealScopeNamespaceWide, sealScopeClusterWide)
+		}
+		var err error
+		publicKey, err = loadSealingCert(opts.Seal)
+		if err != nil {
+			return err
+		}
+	}
+
 	// load secrets from path
-	secrets, err := LoadSecretsFromPath(path)
+	secrets, err := LoadSecretsFromPath(path, opts.Jobs)
 	if err != nil {
 		return fmt.Errorf("failed to load secrets: %w", err)
 	}
@@ -30,24 +44,29 @@ func handleManifest(path string) error {
 			return fmt.Errorf("failed to convert %s/%s: %w", secret.Namespace, secret.Name, err)
 		}
 
+		// ConfigMaps are not sensitive and never sealed
+		if publicKey != nil && !secret.IsConfigMap() {
+			if err := printSealedSecret(secret, k8sData, publicKey, opts.SealScope); err != nil {
+				return fmt.Errorf("failed to seal %s/%s: %w", secret.Namespace, secret.Name, err)
+			}
+			continue
+		}
+
 		// print YAML manifest
 		fmt.Printf("apiVersion: v1\n")
-		fmt.Printf("kind: Secret\n")
+		fmt.Printf("kind: %s\n", secret.Kind)
 		fmt.Printf("metadata:\n")
 		fmt.Printf("  name: %s\n", secret.Name)
 		fmt.Printf("  namespace: %s\n", secret.Namespace)
-		fmt.Printf("type: %s\n", secret.Type)
-		fmt.Printf("stringData:\n")
-
-		// sort keys for consistent output
-		keys := make([]string, 0, len(k8sData))
-		for k := range k8sData {
-			keys = append(keys, k)
+		if secret.IsConfigMap() {
+			fmt.Printf("data:\n")
+		} else {
+			fmt.Printf("type: %s\n", secret.Type)
+			fmt.Printf("stringData:\n")
 		}
-		sort.Strings(keys)
 
 		// print plain text values
-		for _, key := range keys {
+		for _, key := range sortedKeys(k8sData) {
 			value := k8sData[key]
 			// quote values for YAML safety
 			fmt.Printf("  %s: %q\n", key, value)
@@ -56,3 +75,51 @@ func handleManifest(path string) error {
 
 	return nil
 }
+
+// printSealedSecret prints a SealedSecret manifest with every value encrypted for scope
+func printSealedSecret(secret *Secret, k8sData map[string]string, publicKey *rsa.PublicKey, scope string) error {
+	// encrypt everything before printing, so a failure leaves no partial manifest
+	encrypted := make(map[string]string)
+	for key, value := range k8sData {
+		sealed, err := sealValue(publicKey, scope, secret.Namespace, secret.Name, value)
+		if err != nil {
+			return err
+		}
+		encrypted[key] = sealed
+	}
+
+	metadata := func(indent string) {
+		fmt.Printf("%sname: %s\n", indent, secret.Name)
+		fmt.Printf("%snamespace: %s\n", indent, secret.Namespace)
+		if annotation := sealAnnotation(scope); annotation != "" {
+			fmt.Printf("%sannotations:\n", indent)
+			fmt.Printf("%s  %s: \"true\"\n", indent, annotation)
+		}
+	}
+
+	fmt.Printf("apiVersion: bitnami.com/v1alpha1\n")
+	fmt.Printf("kind: SealedSecret\n")
+	fmt.Printf("metadata:\n")
+	metadata("  ")
+	fmt.Printf("spec:\n")
+	fmt.Printf("  encryptedData:\n")
+	for _, key := range sortedKeys(encrypted) {
+		fmt.Printf("    %s: %s\n", key, encrypted[key])
+	}
+	fmt.Printf("  template:\n")
+	fmt.Printf("    metadata:\n")
+	metadata("      ")
+	fmt.Printf("    type: %s\n", secret.Type)
+
+	return nil
+}
+
+// sortedKeys returns the keys of m in sorted order for consistent output
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// syncStatus is the state of the reconciler served on the status endpoints
+type syncStatus struct {
+	mutex    sync.Mutex
+	interval time.Duration
+
+	Syncs          int       `json:"syncs"`
+	LastSync       time.Time `json:"lastSync"`
+	LastCompleted  time.Time `json:"lastCompleted"`
+	LastSuccess    time.Time `json:"lastSuccess"`
+	LastError      string    `json:"lastError,omitempty"`
+	SecretsChanged int       `json:"secretsChanged"`
+	Applied        []string  `json:"applied"`
+	Errors         []string  `json:"errors,omitempty"`
+}
+
+// record stores the outcome of a sync that started at started and just completed
+func (s *syncStatus) record(started time.Time, result *uploadResult, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Syncs++
+	s.LastSync = started
+	s.LastCompleted = time.Now()
+	s.LastError = ""
+	s.SecretsChanged = 0
+	s.Applied = nil
+	s.Errors = nil
+
+	if result != nil {
+		s.SecretsChanged = result.SecretsChanged
+		s.Applied = result.Applied
+		for _, err := range result.Errors {
+			s.Errors = append(s.Errors, err.Error())
+		}
+	}
+
+	switch {
+	case err != nil:
+		s.LastError = err.Error()
+	case len(s.Errors) > 0:
+		s.LastError = fmt.Sprintf("completed with %d error(s)", len(s.Errors))
+	default:
+		s.LastSuccess = started
+	}
+}
+
+// ready reports whether the reconciler completes its syncs, the last one must be recent enough
+// a sync may take a while, so up to three intervals are accepted
+// failed secrets do not make the reconciler unready, they are reported on /status
+func (s *syncStatus) ready() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Syncs == 0 {
+		return errors.New("no sync yet")
+	}
+	if age := time.Since(s.LastCompleted); age > 3*s.interval {
+		return fmt.Errorf("last sync completed %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// handler serves /healthz (the process is alive), /readyz (syncs complete) and /status (JSON)
+func (s *syncStatus) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s)
+	})
+
+	return mux
+}
+
+// handleReconcile applies the secrets at path every interval like upload -doit, until ctx is done
+// the files are reloaded for every sync, so an updated checkout is picked up
+func handleReconcile(ctx context.Context, kube Kube, path string, opts Options) error {
+	if opts.Interval <= 0 {
+		return fmt.Errorf("-interval must be positive, got %s", opts.Interval)
+	}
+	opts.Doit = true
+
+	status := &syncStatus{interval: opts.Interval}
+
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", opts.Listen, err)
+	}
+	server := &http.Server{Handler: status.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("warning: status server failed: %v\n", err)
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("reconciling %s every %s, status on %s\n", path, opts.Interval, listener.Addr())
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		reconcileOnce(ctx, kube, path, opts, status)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcileOnce runs a single sync and records its outcome
+func reconcileOnce(ctx context.Context, kube Kube, path string, opts Options, status *syncStatus) {
+	// the checkout may have moved to another commit since the last sync
+	resetGitCommits()
+
+	started := time.Now()
+	fmt.Printf("\nsync started at %s\n", started.Format(time.RFC3339))
+
+	result, err := upload(ctx, kube, path, opts)
+	if err != nil {
+		fmt.Printf("sync failed: %v\n", err)
+	}
+	status.record(started, result, err)
+}
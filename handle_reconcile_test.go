@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReconcileStatus(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+
+	status := &syncStatus{interval: time.Minute}
+	handler := status.handler()
+
+	readyz := func() int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		return recorder.Code
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before the first sync, got %d", code)
+	}
+
+	opts := Options{Doit: true, Jobs: 2}
+	reconcileOnce(context.Background(), kube, "secrets", opts, status)
+
+	getTestSecret(t, clientset, "test", "app")
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("expected ready after a successful sync, got %d: %s", code, status.LastError)
+	}
+	if status.SecretsChanged != 1 || len(status.Applied) != 1 {
+		t.Errorf("expected one applied secret, got %d changed, applied %v", status.SecretsChanged, status.Applied)
+	}
+
+	// a broken file fails the sync, that is reported on /status
+	writeTestFile(t, "secrets/test/broken.env", "not a key value line\n")
+	reconcileOnce(context.Background(), kube, "secrets", opts, status)
+
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("expected ready after a completed sync with errors, got %d", code)
+	}
+	if status.Syncs != 2 || status.LastError == "" {
+		t.Errorf("expected 2 syncs with an error, got %d syncs, error %q", status.Syncs, status.LastError)
+	}
+
+	// syncs that stopped completing make the reconciler unready
+	status.LastCompleted = time.Now().Add(-time.Hour)
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready without a recent sync, got %d", code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// handleRefs shows which workloads and containers use each local secret and key
+func handleRefs(ctx context.Context, kube Kube, path string, opts Options) error {
+	secrets, err := LoadSecretsFromPath(path, opts.Jobs)
+	if err != nil {
+		return fmt.Errorf("failed to load secrets: %w", err)
+	}
+
+	if len(secrets) == 0 {
+		fmt.Printf("no secrets found in %s\n", path)
+		return nil
+	}
+
+	fmt.Printf("target: %s\n\n", kube.target())
+
+	var unreferenced []string
+	var missingKeys []string
+
+	for _, namespace := range secretNamespaces(secrets) {
+		if ctx.Err() != nil {
+			return fmt.Errorf("interrupted: %w", ctx.Err())
+		}
+
+		workloads, err := kube.listWorkloads(ctx, namespace)
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", kube.namespace(namespace), err)
+		}
+		refs := refsBySecret(workloads)
+
+		for _, secret := range secrets {
+			if secret.Namespace != namespace || secret.IsConfigMap() {
+				continue
+			}
+			secretName := secret.Namespace + "/" + secret.Name
+
+			secretRefs := refs[secret.Name]
+			if len(secretRefs) == 0 {
+				fmt.Printf("secret %s: not referenced\n", secretName)
+				unreferenced = append(unreferenced, secretName)
+				continue
+			}
+
+			// references use the keys as stored in Kubernetes
+			k8sData, err := secret.ToKubernetesData()
+			if err != nil {
+				return fmt.Errorf("conversion failed for %s: %w", secretName, err)
+			}
+
+			fmt.Printf("secret %s:\n", secretName)
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+			keys := make([]string, 0, len(k8sData))
+			for key := range k8sData {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				found := false
+				for _, ref := range secretRefs {
+					if ref.Key == "" || ref.Key == key {
+						printRef(w, key, ref, "")
+						found = true
+					}
+				}
+				if !found {
+					fmt.Fprintf(w, "  %s\t-\n", key)
+				}
+			}
+
+			// references to keys the secret doesn't have
+			for _, ref := range secretRefs {
+				if _, exists := k8sData[ref.Key]; ref.Key != "" && !exists {
+					note := "missing"
+					if !ref.Optional {
+						missingKeys = append(missingKeys, fmt.Sprintf("%s %s (%s)", secretName, ref.Key, ref.Workload))
+						note = "MISSING"
+					}
+					printRef(w, ref.Key, ref, note)
+				}
+			}
+
+			w.Flush()
+		}
+	}
+
+	fmt.Printf("\n")
+	printSecretList("unreferenced secrets", unreferenced)
+	if len(missingKeys) > 0 {
+		printSecretList("required keys missing", missingKeys)
+	}
+
+	return nil
+}
+
+// printRef prints a reference as a row of key, workload, container, source and note
+func printRef(w *tabwriter.Writer, key string, ref SecretRef, note string) {
+	container := ref.Container
+	if container == "" {
+		container = "-"
+	}
+	if note == "" && ref.Optional {
+		note = "optional"
+	}
+	fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", key, ref.Workload, container, ref.Via, note)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// handleRollback restores a previous version of a secret from its history
+// target is <namespace>/<name>, version 0 means the latest saved version
+// the diff against the current state is always shown, doit restores it
+func handleRollback(ctx context.Context, kube Kube, target string, version int, opts Options) error {
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid secret: expected <namespace>/<name>, got %s", target)
+	}
+	namespace, secretName := parts[0], parts[1]
+
+	entries, err := kube.secretHistory(ctx, namespace, secretName)
+	if err != nil {
+		return fmt.Errorf("failed to read history of %s: %w", target, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no saved versions of %s", target)
+	}
+
+	fmt.Printf("target: %s\n\n", kube.target())
+
+	fmt.Printf("saved versions of %s:\n", target)
+	for _, entry := range entries {
+		fmt.Printf("  %d  %s\n", entry.Version, entry.SavedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("\n")
+
+	// pick the version to restore
+	var restore *BackupEntry
+	for i := range entries {
+		if (version == 0 && i == len(entries)-1) || entries[i].Version == version {
+			restore = &entries[i]
+		}
+	}
+	if restore == nil {
+		return fmt.Errorf("version %d of %s not found", version, target)
+	}
+	saved := restore.Secret
+
+	// the current state, the secret may have been pruned
+	current, err := kube.getSecret(ctx, namespace, secretName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to read secret %s: %w", target, err)
+	}
+
+	savedLabel := fmt.Sprintf("version %d", restore.Version)
+	differences := 0
+	if current == nil {
+		fmt.Printf("secret %s is missing\n", target)
+		differences++
+	} else {
+		if current.Type != saved.Type {
+			fmt.Printf("secret %s: type changed\n", target)
+			fmt.Printf("  current: %s\n", current.Type)
+			fmt.Printf("  %s: %s\n", savedLabel, saved.Type)
+			differences++
+		}
+		differences += compareSecretsLocal("current", savedLabel, secretStringData(current), secretStringData(saved), nil, opts.Verbose)
+	}
+	fmt.Printf("%d difference(s)\n", differences)
+
+	if !opts.Doit {
+		return nil
+	}
+
+	if differences == 0 {
+		fmt.Printf("\nsecret %s already matches version %d\n", target, restore.Version)
+		return nil
+	}
+
+	// the same gates as for an upload
+	if current != nil && !isManaged(current) && !opts.Adopt {
+		return fmt.Errorf("secret %s is not managed by kubesops%s, use -adopt to take it over", target, managerSuffix(current))
+	}
+	if current != nil && current.Type != saved.Type && !opts.Recreate {
+		return fmt.Errorf("rolling back %s changes its type from %s to %s, use -recreate to delete and recreate the secret", target, current.Type, saved.Type)
+	}
+
+	fmt.Printf("\nrolling back secret %s to version %d...\n", target, restore.Version)
+
+	// an existing secret keeps its metadata, a missing one gets the saved labels and annotations back
+	// with -recreate a type change recreates the secret
+	meta := savedManagedMeta(saved)
+	if current == nil {
+		meta = managedMeta{Labels: saved.Labels, Annotations: saved.Annotations}
+	}
+
+	err = kube.secretWrite(ctx, namespace, secretName, string(saved.Type), secretStringData(saved), meta, current)
+	if err != nil {
+		return fmt.Errorf("failed to roll back %s: %w", target, err)
+	}
+
+	fmt.Printf("rolled back secret %s to version %d\n", target, restore.Version)
+	return nil
+}
+
+// savedManagedMeta returns the kubesops labels and annotations of a saved secret
+func savedManagedMeta(saved *corev1.Secret) managedMeta {
+	meta := managedMeta{
+		Labels:      make(map[string]string),
+		Annotations: make(map[string]string),
+	}
+
+	if value, ok := saved.Labels[managedByLabel]; ok && value == managedByValue {
+		meta.Labels[managedByLabel] = value
+	}
+	for _, key := range []string{sourceAnnotation, commitAnnotation} {
+		if value, ok := saved.Annotations[key]; ok {
+			meta.Annotations[key] = value
+		}
+	}
+
+	return meta
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 func FromOnsiteSecret(secret *Secret) (map[string]string, error) {
 	return secret.Data, nil
 }
 
-func FromRemoteSecret(namespace, name, secretType string) (map[string]string, error) {
-	k8sData, err := secretRead(namespace, name)
-	if err != nil {
-		return nil, err
-	}
-
-	remoteData, err := FromKubernetesData(secretType, k8sData)
+func FromRemoteSecret(remote *corev1.Secret, secretType string) (map[string]string, error) {
+	remoteData, err := FromKubernetesData(secretType, secretStringData(remote))
 	if err != nil {
 		return nil, fmt.Errorf("conversion failed: %w", err)
 	}
@@ -22,28 +24,196 @@ func FromRemoteSecret(namespace, name, secretType string) (map[string]string, er
 	return remoteData, nil
 }
 
+// uploadResult summarizes what an upload did
+type uploadResult struct {
+	SecretsChanged int      // secrets that differ from the local files
+	KeysChanged    int      // differences over all secrets
+	Applied        []string // secrets written or deleted and workloads restarted
+	NotApplied     []string // secrets and workloads that failed or were skipped after an interruption
+	Errors         []error  // failures that did not stop the upload
+}
+
 // upload is the unified function that handles both diff and upload operations
-// force: if true, upload even if no changes detected
-// doit: if true, actually perform the upload; if false, just show what would be done (dry-run)
-// verbose: if true, show full values in diff output
-func upload(path string, force, doit, verbose bool) error {
-	secrets, err := LoadSecretsFromPath(path)
+// opts.Force: if true, upload even if no changes detected
+// opts.Doit: if true, actually perform the upload; if false, just show what would be done (dry-run)
+// opts.Verbose: if true, show full values in diff output
+// opts.Jobs: number of parallel workers for decryption and remote reads
+func upload(ctx context.Context, kube Kube, path string, opts Options) (*uploadResult, error) {
+	filter, err := newSecretFilter(opts)
 	if err != nil {
-		return fmt.Errorf("failed to load secrets: %w", err)
+		return nil, err
+	}
+	// writing or pruning a part of the secrets only is not supported
+	if filter.active() && (opts.Doit || opts.Prune) {
+		return nil, fmt.Errorf("-name, -type and -selector only apply to download and diff")
+	}
+
+	allSecrets, err := LoadSecretsFromPath(path, opts.Jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
 	}
 
+	// filters narrow down the secrets to diff
+	secrets := filter.selectLocal(allSecrets)
 	if len(secrets) == 0 {
 		fmt.Printf("no secrets found in %s\n", path)
-		return nil
+		return &uploadResult{}, nil
 	}
 
+	// pruning a single file would delete every other secret in its namespace
+	if opts.Prune {
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("-prune requires a directory, got %s", path)
+		}
+	}
+
+	fmt.Printf("target: %s\n", kube.target())
+	if kube.namespacePrefix() != "" {
+		fmt.Printf("namespace prefix: %s\n", kube.namespacePrefix())
+	}
+	fmt.Printf("\n")
+
 	secretsChanged := 0
+	secretsUnmanaged := 0
 	keysChanged := 0
 	var errors []error
+	var applied []string
+	var notApplied []string
+	var retried []string
+	secretsVerified := 0
+	changed := make(map[string]map[string]bool) // namespace -> names of changed secrets
 
-	for _, secret := range secrets {
+	// missing namespaces are part of the plan
+	missingNamespaces, err := findMissingNamespaces(ctx, kube, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// count the retries of all requests per secret
+	secretCtxs := make([]context.Context, len(secrets))
+	retryCounters := make([]*retryCounter, len(secrets))
+	for i := range secrets {
+		secretCtxs[i], retryCounters[i] = withRetryCounter(ctx)
+	}
+
+	// read remote secrets in parallel, the diff below is printed in order
+	// ConfigMaps are compared as secrets, the original is kept for the write
+	remoteSecrets := make([]*corev1.Secret, len(secrets))
+	remoteConfigMaps := make([]*corev1.ConfigMap, len(secrets))
+	remoteErrs := make([]error, len(secrets))
+	forEachParallel(opts.Jobs, len(secrets), func(i int) {
+		secret := secrets[i]
+		if secret.IsConfigMap() {
+			remoteConfigMaps[i], remoteErrs[i] = kube.getConfigMap(secretCtxs[i], secret.Namespace, secret.Name)
+			if remoteErrs[i] == nil {
+				remoteSecrets[i] = configMapAsSecret(remoteConfigMaps[i])
+			}
+			return
+		}
+		remoteSecrets[i], remoteErrs[i] = kube.getSecret(secretCtxs[i], secret.Namespace, secret.Name)
+	})
+
+	// managed remote secrets whose local file was removed
+	var prunable []prunableSecret
+	if opts.Prune {
+		prunable, err = findPrunable(ctx, kube, allSecrets)
+		if err != nil {
+			fmt.Printf("warning: %v\n", err)
+			errors = append(errors, err)
+		}
+	}
+
+	// workloads are only checked when keys or secrets are removed
+	removedKeys, deleted := findRemovals(secrets, remoteSecrets, prunable)
+	var workloadNamespaces []string
+	if !opts.AllowBreaking {
+		workloadNamespaces = removalNamespaces(removedKeys, deleted)
+	}
+
+	// make sure all writes are allowed before touching anything
+	// when impersonating, the matrix is also shown for dry-runs to test roles
+	if opts.Doit || opts.As != "" || len(opts.AsGroups) > 0 {
+		// secrets are written with server-side apply (patch, create for missing ones),
+		// their history secrets are created or updated
+		required := []string{"get", "create", "update", "patch"}
+		if opts.Recreate {
+			required = append(required, "delete")
+		}
+		if opts.Prune {
+			required = append(required, "list", "delete")
+		}
+		err := preflightPermissions(ctx, kube, preflight{
+			Namespaces:       secretNamespaces(secrets),
+			ConfigMaps:       configMapNamespaces(secrets),
+			Required:         required,
+			CreateNamespaces: opts.CreateNamespaces && len(missingNamespaces) > 0,
+			Restart:          opts.Restart,
+			Workloads:        workloadNamespaces,
+		}, opts.Jobs)
+		if err != nil {
+			if opts.Doit {
+				return nil, err
+			}
+			fmt.Printf("warning: %v\n\n", err)
+		}
+	}
+
+	for _, namespace := range missingNamespaces {
+		remoteNamespace := kube.namespace(namespace)
+		if !opts.CreateNamespaces {
+			fmt.Printf("namespace %s is missing, use -create-namespaces to create it\n", remoteNamespace)
+			continue
+		}
+		fmt.Printf("namespace %s is missing\n", remoteNamespace)
+		if opts.Doit {
+			fmt.Printf("creating namespace %s...\n", remoteNamespace)
+			if err := kube.createNamespace(ctx, namespace, opts.NamespaceLabels); err != nil {
+				fmt.Printf("warning: namespace creation failed for %s: %v\n", remoteNamespace, err)
+				errors = append(errors, fmt.Errorf("namespace %s: %w", remoteNamespace, err))
+			}
+		}
+	}
+
+	// removing keys or secrets that workloads require breaks their next pod start
+	broken, err := findBrokenRefs(ctx, kube, removedKeys, deleted)
+	if err != nil {
+		if opts.Doit && !opts.AllowBreaking {
+			return nil, fmt.Errorf("failed to check workload references, use -allow-breaking to skip: %w", err)
+		}
+		fmt.Printf("warning: failed to check workload references: %v\n\n", err)
+	}
+	if len(broken) > 0 {
+		fmt.Printf("required references would break:\n")
+		for _, b := range broken {
+			fmt.Printf("  %s\n", b)
+		}
+		fmt.Printf("\n")
+		if opts.Doit && !opts.AllowBreaking {
+			return nil, fmt.Errorf("%d required reference(s) would break, use -allow-breaking to upload anyway", len(broken))
+		}
+	}
+
+	for i, secret := range secrets {
 		secretName := secret.Namespace + "/" + secret.Name
+		secretCtx := secretCtxs[i]
 		differences := 0
+		unmanaged := false
+
+		// stop early on Ctrl-C, everything left is reported as not applied
+		if ctx.Err() != nil {
+			notApplied = append(notApplied, secretName)
+			continue
+		}
+
+		// the selector applies to the remote labels, missing secrets never match it
+		if remoteErrs[i] == nil || apierrors.IsNotFound(remoteErrs[i]) {
+			if !filter.matchesLabels(remoteSecrets[i]) {
+				if remoteSecrets[i] == nil {
+					fmt.Printf("skipping %s %s: missing remotely, -selector only matches existing ones\n", objectKind(secret), secretName)
+				}
+				continue
+			}
+		}
 
 		onsiteMap, err := FromOnsiteSecret(secret)
 		if err != nil {
@@ -52,53 +222,404 @@ func upload(path string, force, doit, verbose bool) error {
 			continue
 		}
 
-		remoteMap, err := FromRemoteSecret(secret.Namespace, secret.Name, secret.Type)
+		remoteSecret := remoteSecrets[i]
 
-		if err != nil {
-			fmt.Printf("secret %s is missing\n", secretName)
+		if err := remoteErrs[i]; err != nil {
+			if !apierrors.IsNotFound(err) {
+				fmt.Printf("warning: failed to read remote secret %s: %v\n", secretName, err)
+				errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+				notApplied = append(notApplied, secretName)
+				continue
+			}
+			fmt.Printf("%s %s is missing\n", objectKind(secret), secretName)
 			differences = 1 // treat missing secret as a change
 		} else {
-			differences = compareSecretsRemote(secretName, onsiteMap, remoteMap, verbose)
+			// the remote data is converted according to its own type, it may differ from the local one
+			remoteMap, err := FromRemoteSecret(remoteSecret, string(remoteSecret.Type))
+			if err != nil {
+				fmt.Printf("warning: failed to read remote secret %s: %v\n", secretName, err)
+				errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+				notApplied = append(notApplied, secretName)
+				continue
+			}
+			// ownership is not a difference, taking over a secret managed by something else needs -adopt
+			if !isManaged(remoteSecret) {
+				unmanaged = true
+				secretsUnmanaged++
+				fmt.Printf("%s %s: not managed by kubesops%s\n", objectKind(secret), secretName, managerSuffix(remoteSecret))
+			}
+			if typeChanged(secret, remoteSecret) {
+				fmt.Printf("secret %s: type changed\n", secretName)
+				fmt.Printf("  remote: %s\n", remoteSecret.Type)
+				fmt.Printf("  onsite: %s\n", secret.Type)
+				differences++
+			}
+			differences += compareSecretsRemote(secretName, onsiteMap, remoteMap, secret.Plaintext, opts.Verbose)
 		}
 
 		if differences > 0 {
 			secretsChanged++
 			keysChanged += differences
+			if !opts.Doit && !secret.IsConfigMap() {
+				markChanged(changed, secret)
+			}
 		}
 
 		// upload if forced or if there are changes and doit is true
-		if force || (differences > 0 && doit) {
-			if doit {
-				fmt.Printf("uploading secret %s...\n", secretName)
+		// adopting an unmanaged secret stamps the ownership label, even without changes
+		if opts.Force || ((differences > 0 || (unmanaged && opts.Adopt)) && opts.Doit) {
+			if opts.Doit {
+				if unmanaged && !opts.Adopt {
+					err := fmt.Errorf("not managed by kubesops, use -adopt to take it over")
+					fmt.Printf("warning: upload failed for %s: %v\n", secretName, err)
+					errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+					notApplied = append(notApplied, secretName)
+					continue
+				}
+
+				fmt.Printf("uploading %s %s...\n", objectKind(secret), secretName)
 
 				k8sData, err := secret.ToKubernetesData()
 				if err != nil {
 					fmt.Printf("warning: conversion failed for %s: %v\n", secretName, err)
 					errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+					notApplied = append(notApplied, secretName)
 					continue
 				}
 
-				if err := secretWrite(secret.Namespace, secret.Name, secret.Type, k8sData); err != nil {
+				meta := managedMetadata(secret)
+
+				// a type change recreates the secret, that needs -recreate
+				if typeChanged(secret, remoteSecret) && !secret.IsConfigMap() && !opts.Recreate {
+					err := fmt.Errorf("type changed from %s to %s, use -recreate to delete and recreate the secret", remoteSecret.Type, secret.Type)
 					fmt.Printf("warning: upload failed for %s: %v\n", secretName, err)
 					errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+					notApplied = append(notApplied, secretName)
+					continue
+				}
+
+				if secret.IsConfigMap() {
+					err = kube.configMapWrite(secretCtx, secret.Namespace, secret.Name, k8sData, meta, remoteConfigMaps[i])
+				} else {
+					err = kube.secretWrite(secretCtx, secret.Namespace, secret.Name, secret.Type, k8sData, meta, remoteSecret)
+				}
+
+				if err != nil {
+					if isRemoteChanged(err) {
+						showChangedRemote(ctx, kube, secret, onsiteMap, opts.Verbose)
+					}
+					fmt.Printf("warning: upload failed for %s: %v\n", secretName, err)
+					errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+					notApplied = append(notApplied, secretName)
+					continue
+				}
+
+				applied = append(applied, secretName)
+				// a forced upload without differences leaves the workloads alone
+				if differences > 0 && !secret.IsConfigMap() {
+					markChanged(changed, secret)
+				}
+
+				// webhooks or controllers may alter the data after the write
+				if err := verifyUpload(secretCtx, kube, secret, k8sData); err != nil {
+					fmt.Printf("warning: verification failed for %s: %v\n", secretName, err)
+					errors = append(errors, fmt.Errorf("%s: verification failed: %w", secretName, err))
+				} else {
+					secretsVerified++
+				}
+
+				if retries := retryCounters[i].Retries(); retries > 0 {
+					retried = append(retried, fmt.Sprintf("%s (%d retries)", secretName, retries))
+				}
+			}
+		}
+	}
+
+	// delete the managed remote secrets found before the upload
+	secretsPruned := 0
+	if opts.Prune && ctx.Err() == nil {
+		for _, p := range prunable {
+			secretName := p.Namespace + "/" + p.Secret.Name
+			if ctx.Err() != nil {
+				notApplied = append(notApplied, secretName)
+				continue
+			}
+
+			fmt.Printf("secret %s: no local file, prune\n", secretName)
+			secretsPruned++
+
+			if opts.Doit {
+				fmt.Printf("deleting secret %s...\n", secretName)
+				if err := kube.secretDelete(ctx, p.Namespace, p.Secret); err != nil {
+					fmt.Printf("warning: delete failed for %s: %v\n", secretName, err)
+					errors = append(errors, fmt.Errorf("%s: %w", secretName, err))
+					notApplied = append(notApplied, secretName)
+					continue
+				}
+				applied = append(applied, secretName)
+			}
+		}
+	}
+
+	// workloads keep stale values from env vars until their pods are restarted
+	workloadsRestarted := 0
+	if opts.Restart && ctx.Err() == nil {
+		for _, namespace := range secretNamespaces(secrets) {
+			if len(changed[namespace]) == 0 {
+				continue
+			}
+
+			workloads, err := kube.listWorkloads(ctx, namespace)
+			if err != nil {
+				fmt.Printf("warning: %v\n", err)
+				errors = append(errors, fmt.Errorf("namespace %s: %w", kube.namespace(namespace), err))
+				continue
+			}
+
+			for _, w := range workloadsToRestart(workloads, changed[namespace]) {
+				workloadName := kube.namespace(namespace) + "/" + w.String()
+				if ctx.Err() != nil {
+					notApplied = append(notApplied, workloadName)
 					continue
 				}
+
+				fmt.Printf("workload %s uses a changed secret, restart\n", workloadName)
+				workloadsRestarted++
+
+				if opts.Doit {
+					fmt.Printf("restarting %s...\n", workloadName)
+					if err := kube.restartWorkload(ctx, namespace, w); err != nil {
+						fmt.Printf("warning: restart failed for %s: %v\n", workloadName, err)
+						errors = append(errors, fmt.Errorf("%s: %w", workloadName, err))
+						notApplied = append(notApplied, workloadName)
+						continue
+					}
+					applied = append(applied, workloadName)
+				}
 			}
 		}
 	}
 
 	fmt.Printf("\n")
 
+	if len(missingNamespaces) > 0 {
+		fmt.Printf("namespaces missing: %d\n", len(missingNamespaces))
+	}
 	fmt.Printf("secrets changed: %d\n", secretsChanged)
 	fmt.Printf("keys changed: %d\n", keysChanged)
+	if secretsUnmanaged > 0 {
+		fmt.Printf("secrets not managed by kubesops: %d\n", secretsUnmanaged)
+	}
+	if opts.Prune {
+		fmt.Printf("secrets pruned: %d\n", secretsPruned)
+	}
+	if opts.Doit {
+		fmt.Printf("secrets verified: %d\n", secretsVerified)
+	}
+	if opts.Restart {
+		fmt.Printf("workloads restarted: %d\n", workloadsRestarted)
+	}
+
+	if len(retried) > 0 {
+		printSecretList("succeeded after retries", retried)
+	}
 
 	if len(errors) > 0 {
 		fmt.Printf("completed with %d error(s)\n", len(errors))
+		for _, err := range errors {
+			fmt.Printf("  %v\n", err)
+		}
+	}
+
+	result := &uploadResult{
+		SecretsChanged: secretsChanged,
+		KeysChanged:    keysChanged,
+		Applied:        applied,
+		NotApplied:     notApplied,
+		Errors:         errors,
+	}
+
+	if ctx.Err() != nil {
+		fmt.Printf("\ninterrupted\n")
+		printSecretList("applied", applied)
+		printSecretList("not applied", notApplied)
+		return result, fmt.Errorf("interrupted: %d secret(s) applied, %d not applied", len(applied), len(notApplied))
+	}
+
+	// the errors are listed above, a failed upload must not look like a successful one
+	if len(errors) > 0 {
+		return result, fmt.Errorf("completed with %d error(s)", len(errors))
 	}
 
-	return nil
+	return result, nil
+}
+
+// secretNamespaces returns the distinct namespaces of secrets in order of appearance
+func secretNamespaces(secrets []*Secret) []string {
+	var namespaces []string
+	seen := make(map[string]bool)
+
+	for _, secret := range secrets {
+		if !seen[secret.Namespace] {
+			seen[secret.Namespace] = true
+			namespaces = append(namespaces, secret.Namespace)
+		}
+	}
+
+	return namespaces
+}
+
+// configMapNamespaces returns the namespaces of the ConfigMaps among secrets in order of appearance
+func configMapNamespaces(secrets []*Secret) []string {
+	var configMaps []*Secret
+	for _, secret := range secrets {
+		if secret.IsConfigMap() {
+			configMaps = append(configMaps, secret)
+		}
+	}
+	return secretNamespaces(configMaps)
+}
+
+// findMissingNamespaces returns the namespaces of secrets that don't exist remotely
+func findMissingNamespaces(ctx context.Context, kube Kube, secrets []*Secret) ([]string, error) {
+	var missing []string
+
+	for _, namespace := range secretNamespaces(secrets) {
+		exists, err := kube.namespaceExists(ctx, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check namespace %s: %w", kube.namespace(namespace), err)
+		}
+		if !exists {
+			missing = append(missing, namespace)
+		}
+	}
+
+	return missing, nil
+}
+
+// findRemovals returns the keys the upload removes from existing secrets and the secrets it prunes
+// both maps are keyed by local namespace, then secret name
+func findRemovals(secrets []*Secret, remoteSecrets []*corev1.Secret, prunable []prunableSecret) (map[string]map[string][]string, map[string]map[string]bool) {
+	removedKeys := make(map[string]map[string][]string)
+	deleted := make(map[string]map[string]bool)
+
+	for i, secret := range secrets {
+		remote := remoteSecrets[i]
+		if remote == nil || secret.IsConfigMap() {
+			continue
+		}
+		k8sData, err := secret.ToKubernetesData()
+		if err != nil {
+			continue // reported by the upload
+		}
+		for key := range remote.Data {
+			if _, exists := k8sData[key]; !exists {
+				if removedKeys[secret.Namespace] == nil {
+					removedKeys[secret.Namespace] = make(map[string][]string)
+				}
+				removedKeys[secret.Namespace][secret.Name] = append(removedKeys[secret.Namespace][secret.Name], key)
+			}
+		}
+	}
+
+	for _, p := range prunable {
+		if deleted[p.Namespace] == nil {
+			deleted[p.Namespace] = make(map[string]bool)
+		}
+		deleted[p.Namespace][p.Secret.Name] = true
+	}
+
+	return removedKeys, deleted
+}
+
+// verifyUpload reads a written secret back and compares its content hash with the data sent
+func verifyUpload(ctx context.Context, kube Kube, secret *Secret, sent map[string]string) error {
+	remote, err := getRemote(ctx, kube, secret)
+	if err != nil {
+		return err
+	}
+
+	live := secretStringData(remote)
+	if contentHash(live) == contentHash(sent) {
+		return nil
+	}
+
+	var keys []string
+	for key, value := range sent {
+		if liveValue, exists := live[key]; !exists || liveValue != value {
+			keys = append(keys, key)
+		}
+	}
+	for key := range live {
+		if _, exists := sent[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return fmt.Errorf("content hash %s differs from the uploaded %s, keys changed: %s", contentHash(live), contentHash(sent), strings.Join(keys, ", "))
+}
+
+// objectKind names the kind of a local file for messages
+func objectKind(secret *Secret) string {
+	if secret.IsConfigMap() {
+		return "configmap"
+	}
+	return "secret"
+}
+
+// markChanged records a secret as changed in its namespace
+func markChanged(changed map[string]map[string]bool, secret *Secret) {
+	if changed[secret.Namespace] == nil {
+		changed[secret.Namespace] = make(map[string]bool)
+	}
+	changed[secret.Namespace][secret.Name] = true
+}
+
+// managerSuffix describes what else manages a secret, for messages
+func managerSuffix(secret *corev1.Secret) string {
+	if manager := secretManager(secret); manager != "" {
+		return " (managed by " + manager + ")"
+	}
+	return ""
+}
+
+// typeChanged reports whether the remote secret exists with a different type
+func typeChanged(secret *Secret, remote *corev1.Secret) bool {
+	return remote != nil && string(remote.Type) != secret.Type
+}
+
+// showChangedRemote re-reads a secret that changed since the diff and shows the new diff
+func showChangedRemote(ctx context.Context, kube Kube, secret *Secret, onsiteMap map[string]string, verbose bool) {
+	secretName := secret.Namespace + "/" + secret.Name
+	fmt.Printf("%s %s was changed remotely since the diff, not overwriting\n", objectKind(secret), secretName)
+
+	remoteSecret, err := getRemote(ctx, kube, secret)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			fmt.Printf("%s %s was deleted remotely\n", objectKind(secret), secretName)
+		}
+		return
+	}
+
+	remoteMap, err := FromRemoteSecret(remoteSecret, string(remoteSecret.Type))
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("new diff for %s:\n", secretName)
+	compareSecretsRemote(secretName, onsiteMap, remoteMap, secret.Plaintext, verbose)
+}
+
+// printSecretList prints a titled list of secret names
+func printSecretList(title string, names []string) {
+	fmt.Printf("%s: %d\n", title, len(names))
+	for _, name := range names {
+		fmt.Printf("  %s\n", name)
+	}
 }
 
-func handleUpload(path string, force, doit, verbose bool) error {
-	return upload(path, force, doit, verbose)
+func handleUpload(ctx context.Context, kube Kube, path string, opts Options) error {
+	_, err := upload(ctx, kube, path, opts)
+	return err
 }
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeKube returns a client configured with opts on a fake clientset that allows everything
+// requests are not retried unless opts sets MaxAttempts
+// the test runs in a temporary directory, local files go to secrets/<namespace>/<name>.env
+func newFakeKube(t *testing.T, opts Options, objects ...runtime.Object) (*kubeClient, *fake.Clientset) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	clientset := fake.NewClientset(objects...)
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &authorizationv1.SelfSubjectAccessReview{Status: authorizationv1.SubjectAccessReviewStatus{Allowed: true}}, nil
+	})
+
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = 1
+	}
+	target := &kubeTarget{Context: "test", Cluster: "test", Server: "https://fake"}
+	return newKubeClientForClientset(clientset, target, opts), clientset
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func testSecret(namespace, name string, data map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, ResourceVersion: "1"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       make(map[string][]byte),
+	}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	return secret
+}
+
+func getTestSecret(t *testing.T, clientset *fake.Clientset, namespace, name string) *corev1.Secret {
+	t.Helper()
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get secret %s/%s: %v", namespace, name, err)
+	}
+	return secret
+}
+
+// writes counts the actions that modify secrets
+func writes(clientset *fake.Clientset) int {
+	count := 0
+	for _, action := range clientset.Actions() {
+		if action.GetResource().Resource != "secrets" {
+			continue
+		}
+		switch action.GetVerb() {
+		case "create", "update", "patch", "delete":
+			count++
+		}
+	}
+	return count
+}
+
+func TestUploadCreatesMissingSecret(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/app.env", "USER=admin\nPASSWORD=secret\n")
+
+	if err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	secret := getTestSecret(t, clientset, "test", "app")
+	if string(secret.Data["USER"]) != "admin" || string(secret.Data["PASSWORD"]) != "secret" {
+		t.Errorf("unexpected data %v", secretStringData(secret))
+	}
+	if secret.Labels[managedByLabel] != managedByValue {
+		t.Errorf("missing ownership label, got %v", secret.Labels)
+	}
+	if secret.Annotations[sourceAnnotation] != filepath.Join("secrets", "test", "app.env") {
+		t.Errorf("unexpected source annotation %q", secret.Annotations[sourceAnnotation])
+	}
+}
+
+func TestUploadUpdatesChangedSecret(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	ctx := context.Background()
+
+	writeTestFile(t, "secrets/test/app.env", "USER=admin\nPASSWORD=old\nSTALE=x\n")
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("first upload failed: %v", err)
+	}
+
+	// another controller adds a label
+	secret := getTestSecret(t, clientset, "test", "app")
+	secret.Labels["team"] = "platform"
+	if _, err := clientset.CoreV1().Secrets("test").Update(ctx, secret, metav1.UpdateOptions{FieldManager: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, "secrets/test/app.env", "USER=admin\nPASSWORD=new\n")
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	secret = getTestSecret(t, clientset, "test", "app")
+	if string(secret.Data["PASSWORD"]) != "new" {
+		t.Errorf("expected PASSWORD=new, got %q", secret.Data["PASSWORD"])
+	}
+	if _, exists := secret.Data["STALE"]; exists {
+		t.Errorf("expected STALE to be removed, got %v", secretStringData(secret))
+	}
+	if secret.Labels["team"] != "platform" {
+		t.Errorf("expected foreign label to be kept, got %v", secret.Labels)
+	}
+
+	history, err := kube.secretHistory(ctx, "test", "app")
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 1 || string(history[0].Secret.Data["PASSWORD"]) != "old" {
+		t.Errorf("expected the previous version in the history, got %d entries", len(history))
+	}
+}
+
+func TestUploadSavesHistoryBeforeWrite(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	ctx := context.Background()
+
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=old\n")
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("first upload failed: %v", err)
+	}
+
+	// without a history the secret is not overwritten
+	denyHistory := true
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if denyHistory && action.(k8stesting.CreateAction).GetObject().(*corev1.Secret).Name == historySecretName("app") {
+			return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), historySecretName("app"), errors.New("denied"))
+		}
+		return false, nil, nil
+	})
+
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=new\n")
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err == nil {
+		t.Fatalf("expected the upload to fail without a history")
+	}
+	if secret := getTestSecret(t, clientset, "test", "app"); string(secret.Data["PASSWORD"]) != "old" {
+		t.Errorf("expected PASSWORD=old to be kept, got %q", secret.Data["PASSWORD"])
+	}
+
+	// someone else writes between the diff and the apply, the saved version stays
+	denyHistory = false
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(corev1.Resource("secrets"), "app", errors.New("modified"))
+	})
+	for range 2 {
+		result, _ := upload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2})
+		if result == nil || len(result.Errors) != 1 || !isRemoteChanged(result.Errors[0]) {
+			t.Fatalf("expected a remote change error, got %+v", result)
+		}
+	}
+
+	history, err := kube.secretHistory(ctx, "test", "app")
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 1 || string(history[0].Secret.Data["PASSWORD"]) != "old" {
+		t.Errorf("expected the previous version saved once, got %d entries", len(history))
+	}
+}
+
+func TestUploadReportsConflicts(t *testing.T) {
+	remote := testSecret("test", "app", map[string]string{"PASSWORD": "old"})
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"), remote)
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=new\n")
+
+	// fields set by another manager are only taken over with -force-conflicts
+	err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Adopt: true, Jobs: 2})
+	if err == nil || !strings.Contains(err.Error(), "1 error") {
+		t.Fatalf("expected the conflict to fail the upload, got %v", err)
+	}
+	if secret := getTestSecret(t, clientset, "test", "app"); string(secret.Data["PASSWORD"]) != "old" {
+		t.Errorf("expected conflicting field to be kept, got %q", secret.Data["PASSWORD"])
+	}
+
+	forced := newKubeClientForClientset(clientset, kube.target(), Options{MaxAttempts: 1, ForceConflicts: true})
+	if err := handleUpload(context.Background(), forced, "secrets", Options{Doit: true, Adopt: true, Jobs: 2}); err != nil {
+		t.Fatalf("forced upload failed: %v", err)
+	}
+	if secret := getTestSecret(t, clientset, "test", "app"); string(secret.Data["PASSWORD"]) != "new" {
+		t.Errorf("expected PASSWORD=new, got %q", secret.Data["PASSWORD"])
+	}
+}
+
+func TestUploadRecreatesChangedType(t *testing.T) {
+	remote := testSecret("test", "app", map[string]string{"username": "admin"})
+	remote.UID = "old"
+	remote.Labels = map[string]string{"team": "api"}
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"), remote)
+	ctx := context.Background()
+	writeTestFile(t, "secrets/test/app.env", "# type=basic-auth\nusername=admin\npassword=secret\n")
+
+	// the type is only changed with -recreate
+	result, _ := upload(ctx, kube, "secrets", Options{Doit: true, Adopt: true, Jobs: 2})
+	if result == nil || len(result.Errors) != 1 {
+		t.Fatalf("expected the type change to fail without -recreate, got %+v", result)
+	}
+
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Adopt: true, Recreate: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	secret := getTestSecret(t, clientset, "test", "app")
+	if secret.Type != corev1.SecretTypeBasicAuth || string(secret.Data["password"]) != "secret" {
+		t.Errorf("unexpected secret %s %v", secret.Type, secretStringData(secret))
+	}
+	if secret.Labels["team"] != "api" || secret.Labels[managedByLabel] != managedByValue {
+		t.Errorf("expected labels to be carried over, got %v", secret.Labels)
+	}
+
+	history, err := kube.secretHistory(ctx, "test", "app")
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 1 || history[0].Secret.Type != corev1.SecretTypeOpaque {
+		t.Errorf("expected the previous version in the history, got %d entries", len(history))
+	}
+}
+
+func TestUploadRequiresAdopt(t *testing.T) {
+	remote := testSecret("test", "app", map[string]string{"PASSWORD": "secret"})
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"), remote)
+	ctx := context.Background()
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+
+	// ownership alone is not a change
+	result, err := upload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2})
+	if err != nil || result.SecretsChanged != 0 || writes(clientset) != 0 {
+		t.Fatalf("expected an unmanaged secret without changes to be left alone, got %+v %v", result, err)
+	}
+
+	// changing it requires -adopt
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=new\n")
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err == nil {
+		t.Fatalf("expected the upload to fail without -adopt")
+	}
+	if n := writes(clientset); n != 0 {
+		t.Errorf("expected no writes without -adopt, got %d", n)
+	}
+
+	forced := newKubeClientForClientset(clientset, kube.target(), Options{MaxAttempts: 1, ForceConflicts: true})
+	if err := handleUpload(ctx, forced, "secrets", Options{Doit: true, Adopt: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	secret := getTestSecret(t, clientset, "test", "app")
+	if string(secret.Data["PASSWORD"]) != "new" || !isManaged(secret) {
+		t.Errorf("expected the adopted secret to be updated, got %v %v", secretStringData(secret), secret.Labels)
+	}
+	// the hash of an unencrypted file would reveal the values
+	if _, exists := secret.Annotations[hashAnnotation]; exists {
+		t.Errorf("expected no hash of an unencrypted file, got %v", secret.Annotations)
+	}
+}
+
+func TestUploadDryRunDoesNotWrite(t *testing.T) {
+	remote := testSecret("test", "app", map[string]string{"PASSWORD": "old"})
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"), remote)
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=new\n")
+	writeTestFile(t, "secrets/test/missing.env", "KEY=value\n")
+
+	if err := handleUpload(context.Background(), kube, "secrets", Options{Jobs: 2}); err != nil {
+		t.Fatalf("dry-run failed: %v", err)
+	}
+
+	if n := writes(clientset); n != 0 {
+		t.Errorf("expected no writes in dry-run, got %d", n)
+	}
+	if _, err := clientset.CoreV1().Secrets("test").Get(context.Background(), "missing", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected missing secret to stay missing, got %v", err)
+	}
+}
+
+func TestUploadDockerRegistry(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/registry.env", "# type=docker-registry\ndocker-server=https://ghcr.io\ndocker-username=bot\ndocker-password=token\n")
+
+	if err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	secret := getTestSecret(t, clientset, "test", "registry")
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		t.Errorf("expected type %s, got %s", corev1.SecretTypeDockerConfigJson, secret.Type)
+	}
+	if _, exists := secret.Data[corev1.DockerConfigJsonKey]; !exists {
+		t.Fatalf("expected %s, got %v", corev1.DockerConfigJsonKey, secretStringData(secret))
+	}
+
+	// an unchanged upload is not written again
+	before := writes(clientset)
+	if err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("second upload failed: %v", err)
+	}
+	if after := writes(clientset); after != before {
+		t.Errorf("expected no writes for an unchanged secret, got %d", after-before)
+	}
+}
+
+func TestUploadContinuesAfterErrors(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/a.env", "KEY=a\n")
+	writeTestFile(t, "secrets/test/b.env", "KEY=b\n")
+	writeTestFile(t, "secrets/test/c.env", "KEY=c\n")
+
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.PatchAction).GetName() == "b" {
+			return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), "b", errors.New("denied"))
+		}
+		return false, nil, nil
+	})
+
+	result, err := upload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2})
+	if err == nil || !strings.Contains(err.Error(), "1 error") {
+		t.Fatalf("expected the failed secret to fail the upload, got %v", err)
+	}
+	if len(result.Applied) != 2 || len(result.NotApplied) != 1 || result.NotApplied[0] != "test/b" {
+		t.Errorf("expected a and c applied and b not applied, got %v and %v", result.Applied, result.NotApplied)
+	}
+
+	for _, name := range []string{"a", "c"} {
+		getTestSecret(t, clientset, "test", name)
+	}
+	if _, err := clientset.CoreV1().Secrets("test").Get(context.Background(), "b", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected b to fail, got %v", err)
+	}
+}
+
+func TestUploadPreflightChecksRestart(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		allowed := attributes.Group != "apps" || attributes.Resource != "deployments"
+		return true, &authorizationv1.SelfSubjectAccessReview{Status: authorizationv1.SubjectAccessReviewStatus{Allowed: allowed}}, nil
+	})
+
+	err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Restart: true, Jobs: 2})
+	if err == nil || !strings.Contains(err.Error(), "patch deployments.apps in test") {
+		t.Fatalf("expected missing restart permission, got %v", err)
+	}
+	if n := writes(clientset); n != 0 {
+		t.Errorf("expected no writes, got %d", n)
+	}
+
+	// without -restart the workloads are not touched
+	if err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+}
+
+func TestUploadPreflightChecksApply(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+
+	// server-side apply is a patch
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		allowed := review.Spec.ResourceAttributes.Verb != "patch"
+		return true, &authorizationv1.SelfSubjectAccessReview{Status: authorizationv1.SubjectAccessReviewStatus{Allowed: allowed}}, nil
+	})
+
+	err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2})
+	if err == nil || !strings.Contains(err.Error(), "patch secrets in test") {
+		t.Fatalf("expected missing patch permission, got %v", err)
+	}
+	if n := writes(clientset); n != 0 {
+		t.Errorf("expected no writes, got %d", n)
+	}
+}
+
+func TestUploadPreflightChecksConfigMaps(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"), testNamespace("web"))
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+	writeTestFile(t, "secrets/web/flags.config.env", "FEATURE=on\n")
+
+	// the role may write secrets, but no configmaps
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		allowed := review.Spec.ResourceAttributes.Resource != "configmaps"
+		return true, &authorizationv1.SelfSubjectAccessReview{Status: authorizationv1.SubjectAccessReviewStatus{Allowed: allowed}}, nil
+	})
+
+	err := handleUpload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2})
+	if err == nil || !strings.Contains(err.Error(), "patch configmaps in web") || strings.Contains(err.Error(), "configmaps in test") {
+		t.Fatalf("expected missing configmap permissions in web only, got %v", err)
+	}
+	if n := writes(clientset); n != 0 {
+		t.Errorf("expected no writes, got %d", n)
+	}
+}
+
+func TestUploadPreflightChecksWorkloads(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	ctx := context.Background()
+
+	// the role may write secrets, but not list workloads
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		allowed := review.Spec.ResourceAttributes.Verb != "list" || review.Spec.ResourceAttributes.Resource == "secrets"
+		return true, &authorizationv1.SelfSubjectAccessReview{Status: authorizationv1.SubjectAccessReviewStatus{Allowed: allowed}}, nil
+	})
+
+	// nothing is removed, so workloads are neither needed nor listed
+	writeTestFile(t, "secrets/test/app.env", "USER=admin\nSTALE=x\n")
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "deployments" {
+			t.Errorf("expected no workloads to be listed")
+		}
+	}
+
+	clientset.ClearActions()
+	writeTestFile(t, "secrets/test/app.env", "USER=admin\n")
+	err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2})
+	if err == nil || !strings.Contains(err.Error(), "list deployments.apps in test") || !strings.Contains(err.Error(), "list cronjobs.batch in test") {
+		t.Fatalf("expected missing workload permissions, got %v", err)
+	}
+	if n := writes(clientset); n != 0 {
+		t.Errorf("expected no writes, got %d", n)
+	}
+
+	// -allow-breaking doesn't need to check the references
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, AllowBreaking: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload with -allow-breaking failed: %v", err)
+	}
+}
+
+func TestCanIMapsNamespace(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{NamespacePrefix: "pr-42-"})
+
+	var namespaces []string
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		namespaces = append(namespaces, review.Spec.ResourceAttributes.Namespace)
+		return true, &authorizationv1.SelfSubjectAccessReview{Status: authorizationv1.SubjectAccessReviewStatus{Allowed: true}}, nil
+	})
+
+	// local namespaces are checked in the remote ones, cluster-scoped checks have none
+	for _, namespace := range []string{"api", ""} {
+		if _, err := kube.canI(context.Background(), namespace, "get", "secrets"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(namespaces) != 2 || namespaces[0] != "pr-42-api" || namespaces[1] != "" {
+		t.Errorf("expected pr-42-api and no namespace, got %q", namespaces)
+	}
+}
+
+func TestUploadRestartsWorkloads(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "api"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:    "app",
+				EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}},
+			}},
+		}}},
+	}
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"), deployment)
+	ctx := context.Background()
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Restart: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	deployment, err := clientset.AppsV1().Deployments("test").Get(ctx, "api", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := deployment.Spec.Template.Annotations[restartedAtAnnotation]; !exists {
+		t.Errorf("expected %s on the pod template, got %v", restartedAtAnnotation, deployment.Spec.Template.Annotations)
+	}
+
+	// a forced upload without differences writes the secret but does not restart
+	restarts := func() int {
+		count := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "patch" && action.GetResource().Resource == "deployments" {
+				count++
+			}
+		}
+		return count
+	}
+	before := restarts()
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Force: true, Restart: true, Jobs: 2}); err != nil {
+		t.Fatalf("forced upload failed: %v", err)
+	}
+	if after := restarts(); after != before {
+		t.Errorf("expected no restart for a forced upload without differences, got %d", after-before)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	remote := testSecret("test", "app", map[string]string{"USER": "admin"})
+	kube, _ := newFakeKube(t, Options{}, remote)
+
+	path := filepath.Join("secrets", "test", "app.env")
+	if err := handleDownload(context.Background(), kube, path, Options{Jobs: 2}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+
+	secret, err := LoadSecretFile(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if secret.Data["USER"] != "admin" {
+		t.Errorf("expected USER=admin, got %v", secret.Data)
+	}
+}
+
+func TestDownloadMissingSecret(t *testing.T) {
+	kube, _ := newFakeKube(t, Options{})
+
+	err := handleDownload(context.Background(), kube, filepath.Join("secrets", "test", "missing.env"), Options{Jobs: 2})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestUploadConfigMap(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/app.config.env", "LOG_LEVEL=debug\n")
+	writeTestFile(t, "secrets/test/flags.env", "# kind=ConfigMap\nFEATURE=on\n")
+	ctx := context.Background()
+
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	for name, key := range map[string]string{"app": "LOG_LEVEL", "flags": "FEATURE"} {
+		configMap, err := clientset.CoreV1().ConfigMaps("test").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get configmap %s: %v", name, err)
+		}
+		if _, exists := configMap.Data[key]; !exists || configMap.Labels[managedByLabel] != managedByValue {
+			t.Errorf("unexpected configmap %s: %v %v", name, configMap.Data, configMap.Labels)
+		}
+		if !strings.HasPrefix(configMap.Annotations[hashAnnotation], "sha256:") {
+			t.Errorf("expected the hash of the file on configmap %s, got %v", name, configMap.Annotations)
+		}
+		if _, err := clientset.CoreV1().Secrets("test").Get(ctx, name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected no secret %s, got %v", name, err)
+		}
+	}
+
+	// download writes the files back in the same form
+	if err := os.RemoveAll("secrets"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, "secrets/test/flags.env", "# kind=ConfigMap\n")
+	if err := handleDownload(ctx, kube, filepath.Join("secrets", "test", "flags.env"), Options{Jobs: 2}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	secret, err := LoadSecretFile(filepath.Join("secrets", "test", "flags.env"))
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !secret.IsConfigMap() || secret.Data["FEATURE"] != "on" {
+		t.Errorf("expected configmap with FEATURE=on, got %s %v", secret.Kind, secret.Data)
+	}
+}
+
+func TestUploadConfigMapReplacesBinaryData(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	ctx := context.Background()
+
+	// keys applied by kubesops before, one of them binary
+	live := corev1ac.ConfigMap("flags", "test").
+		WithLabels(map[string]string{managedByLabel: managedByValue}).
+		WithData(map[string]string{"FEATURE": "off", "OLD": "x"}).
+		WithBinaryData(map[string][]byte{"BLOB": {0xff, 0xfe}})
+	if _, err := clientset.CoreV1().ConfigMaps("test").Apply(ctx, live, metav1.ApplyOptions{FieldManager: fieldManager}); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, "secrets/test/flags.config.env", "FEATURE=on\n")
+
+	// binaryData keys count as keys of the remote configmap
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("test").Get(ctx, "flags", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.Data) != 1 || configMap.Data["FEATURE"] != "on" || len(configMap.BinaryData) != 0 {
+		t.Errorf("expected only FEATURE=on, got %v %v", configMap.Data, configMap.BinaryData)
+	}
+}
+
+func TestUploadKeepsForeignKeys(t *testing.T) {
+	remote := testSecret("test", "app", map[string]string{"PASSWORD": "old", "TOKEN": "x"})
+	remote.Labels = map[string]string{managedByLabel: managedByValue}
+	kube, clientset := newFakeKube(t, Options{ForceConflicts: true}, testNamespace("test"), remote)
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=new\n")
+
+	// a server-side apply only removes keys kubesops applied, the verification reports the kept one
+	result, err := upload(context.Background(), kube, "secrets", Options{Doit: true, Jobs: 2})
+	if err == nil || len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), "TOKEN") {
+		t.Fatalf("expected the kept key to be reported, got %+v %v", result, err)
+	}
+	secret := getTestSecret(t, clientset, "test", "app")
+	if string(secret.Data["PASSWORD"]) != "new" || string(secret.Data["TOKEN"]) != "x" {
+		t.Errorf("expected PASSWORD=new and TOKEN to be kept, got %v", secretStringData(secret))
+	}
+}
+
+func TestUploadRefusesFilters(t *testing.T) {
+	kube, clientset := newFakeKube(t, Options{}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/db.env", "PASSWORD=x\n")
+	writeTestFile(t, "secrets/test/cache.env", "PASSWORD=y\n")
+	ctx := context.Background()
+
+	// a diff may look at a part of the secrets
+	if err := handleDiff(ctx, kube, "secrets", "", Options{Jobs: 2, Names: stringList{"db"}}); err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+
+	for _, opts := range []Options{
+		{Doit: true, Jobs: 2, Names: stringList{"db"}},
+		{Prune: true, Jobs: 2, Selector: "team=api"},
+	} {
+		if err := handleUpload(ctx, kube, "secrets", opts); err == nil {
+			t.Errorf("expected upload with filters to fail: %+v", opts)
+		}
+	}
+	if list, _ := clientset.CoreV1().Secrets("test").List(ctx, metav1.ListOptions{}); len(list.Items) != 0 {
+		t.Errorf("expected nothing written, got %d secret(s)", len(list.Items))
+	}
+}
+
+func TestDownloadNamespaceFilters(t *testing.T) {
+	token := testSecret("test", "default-token", map[string]string{"token": "x"})
+	token.Type = corev1.SecretTypeServiceAccountToken
+	release := testSecret("test", "sh.helm.release.v1.api.v1", map[string]string{"release": "x"})
+	release.Type = helmReleaseType
+	owned := testSecret("test", "api-tls", map[string]string{"tls.crt": "x"})
+	owned.OwnerReferences = []metav1.OwnerReference{{Kind: "Certificate", Name: "api"}}
+	db := testSecret("test", "db", map[string]string{"PASSWORD": "x"})
+	db.Labels = map[string]string{"team": "api"}
+	cache := testSecret("test", "cache", map[string]string{"PASSWORD": "y"})
+
+	kube, _ := newFakeKube(t, Options{}, token, release, owned, db, cache)
+	ctx := context.Background()
+
+	if err := handleDownload(ctx, kube, filepath.Join("secrets", "test"), Options{Jobs: 2}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	assertFiles(t, "secrets/test", "cache.env", "db.env")
+
+	// filters narrow down the listing
+	if err := os.RemoveAll("secrets"); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Jobs: 2, Selector: "team=api"}
+	if err := handleDownload(ctx, kube, filepath.Join("secrets", "test"), opts); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	assertFiles(t, "secrets/test", "db.env")
+
+	if err := os.RemoveAll("secrets"); err != nil {
+		t.Fatal(err)
+	}
+	opts = Options{Jobs: 2, Names: stringList{"c*"}}
+	if err := handleDownload(ctx, kube, filepath.Join("secrets", "test"), opts); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	assertFiles(t, "secrets/test", "cache.env")
+}
+
+// assertFiles checks the names of the files in dir
+func assertFiles(t *testing.T, dir string, want ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected files %v in %s, got %v", want, dir, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected files %v in %s, got %v", want, dir, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// handleWatch watches the remote secrets of path and reports drift from the local files
+// with opts.Doit the local state is re-applied whenever a secret drifts
+func handleWatch(ctx context.Context, kube Kube, path string, opts Options) error {
+	secrets, err := LoadSecretsFromPath(path, opts.Jobs)
+	if err != nil {
+		return fmt.Errorf("failed to load secrets: %w", err)
+	}
+
+	if len(secrets) == 0 {
+		fmt.Printf("no secrets found in %s\n", path)
+		return nil
+	}
+
+	// the local state is converted once, the files are not reloaded while watching
+	local := make(map[string]*Secret)
+	localData := make(map[string]map[string]string)
+	for _, secret := range secrets {
+		// only secrets are watched
+		if secret.IsConfigMap() {
+			continue
+		}
+		secretName := secret.Namespace + "/" + secret.Name
+		k8sData, err := secret.ToKubernetesData()
+		if err != nil {
+			return fmt.Errorf("conversion failed for %s: %w", secretName, err)
+		}
+		local[secretName] = secret
+		localData[secretName] = k8sData
+	}
+
+	fmt.Printf("target: %s\n", kube.target())
+	if kube.namespacePrefix() != "" {
+		fmt.Printf("namespace prefix: %s\n", kube.namespacePrefix())
+	}
+	if opts.Doit {
+		fmt.Printf("watching %d secret(s), drift is re-applied\n\n", len(local))
+	} else {
+		fmt.Printf("watching %d secret(s), use -doit to re-apply drift\n\n", len(local))
+	}
+
+	events := make(chan secretEvent)
+	for _, namespace := range secretNamespaces(secrets) {
+		go watchNamespace(ctx, kube, namespace, events)
+	}
+
+	handled := make(map[string]string) // secret -> last handled resourceVersion
+	drifted := make(map[string]bool)
+
+	for {
+		var event secretEvent
+		select {
+		case <-ctx.Done():
+			return nil
+		case event = <-events:
+		}
+
+		if event.Err != nil {
+			fmt.Printf("warning: namespace %s: %v\n", kube.namespace(event.Namespace), event.Err)
+			continue
+		}
+
+		secretName := event.Namespace + "/" + event.Secret.Name
+		secret := local[secretName]
+		if secret == nil {
+			continue
+		}
+
+		if event.Type == watch.Deleted {
+			delete(handled, secretName)
+			drifted[secretName] = true
+			fmt.Printf("secret %s was deleted\n", secretName)
+			if opts.Doit {
+				reapply(ctx, kube, secret, localData[secretName], nil, opts)
+			}
+			continue
+		}
+
+		// restarted watches report every secret again
+		if version, ok := handled[secretName]; ok && version == event.Secret.ResourceVersion {
+			continue
+		}
+		handled[secretName] = event.Secret.ResourceVersion
+
+		remote := event.Secret
+		if string(remote.Type) == secret.Type && contentHash(secretStringData(remote)) == contentHash(localData[secretName]) {
+			if drifted[secretName] {
+				fmt.Printf("secret %s is in sync again\n", secretName)
+				delete(drifted, secretName)
+			}
+			continue
+		}
+
+		drifted[secretName] = true
+		fmt.Printf("secret %s drifted, last changed by %s\n", secretName, lastManager(remote))
+		if typeChanged(secret, remote) {
+			fmt.Printf("secret %s: type changed\n", secretName)
+			fmt.Printf("  remote: %s\n", remote.Type)
+			fmt.Printf("  onsite: %s\n", secret.Type)
+		}
+		remoteMap, err := FromRemoteSecret(remote, string(remote.Type))
+		if err != nil {
+			fmt.Printf("warning: failed to read remote secret %s: %v\n", secretName, err)
+		} else {
+			compareSecretsRemote(secretName, secret.Data, remoteMap, secret.Plaintext, opts.Verbose)
+		}
+
+		if opts.Doit {
+			reapply(ctx, kube, secret, localData[secretName], remote, opts)
+		}
+	}
+}
+
+// reapply writes the local state of a drifted secret, live is nil if it was deleted
+// failures are reported and the watch goes on
+func reapply(ctx context.Context, kube Kube, secret *Secret, k8sData map[string]string, live *corev1.Secret, opts Options) {
+	secretName := secret.Namespace + "/" + secret.Name
+	if live != nil && !isManaged(live) && !opts.Adopt {
+		fmt.Printf("warning: not re-applying %s, it is not managed by kubesops%s, use -adopt to take it over\n", secretName, managerSuffix(live))
+		return
+	}
+	fmt.Printf("re-applying secret %s...\n", secretName)
+
+	meta := managedMetadata(secret)
+
+	// a type change recreates the secret, that needs -recreate
+	if typeChanged(secret, live) && !opts.Recreate {
+		fmt.Printf("warning: re-apply failed for %s: type changed from %s to %s, use -recreate to delete and recreate the secret\n", secretName, live.Type, secret.Type)
+		return
+	}
+
+	if err := kube.secretWrite(ctx, secret.Namespace, secret.Name, secret.Type, k8sData, meta, live); err != nil {
+		fmt.Printf("warning: re-apply failed for %s: %v\n", secretName, err)
+	}
+}
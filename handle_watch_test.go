@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// receive returns the next value of ch, the timeout only guards against a hanging test
+func receive[T any](t *testing.T, what string, ch <-chan T) T {
+	t.Helper()
+	select {
+	case value := <-ch:
+		return value
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		var zero T
+		return zero
+	}
+}
+
+func TestWatchReappliesDrift(t *testing.T) {
+	// fields changed by someone else are taken back
+	kube, clientset := newFakeKube(t, Options{ForceConflicts: true}, testNamespace("test"))
+	writeTestFile(t, "secrets/test/app.env", "PASSWORD=secret\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := handleUpload(ctx, kube, "secrets", Options{Doit: true, Jobs: 2}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	secret := getTestSecret(t, clientset, "test", "app")
+	secret.Data["PASSWORD"] = []byte("changed")
+	drifted, err := clientset.CoreV1().Secrets("test").Update(ctx, secret, metav1.UpdateOptions{FieldManager: "kubectl-edit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the events come from a fake watcher, the re-apply is seen as a patch
+	watcher := watch.NewFake()
+	started := make(chan struct{}, 1)
+	clientset.PrependWatchReactor("secrets", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		started <- struct{}{}
+		return true, watcher, nil
+	})
+	applies := make(chan *corev1.Secret, 1)
+	clientset.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if patch := action.(k8stesting.PatchAction); patch.GetName() == "app" {
+			var secret corev1.Secret
+			if err := json.Unmarshal(patch.GetPatch(), &secret); err != nil {
+				t.Errorf("invalid apply patch: %v", err)
+			}
+			applies <- &secret
+		}
+		return false, nil, nil
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- handleWatch(ctx, kube, "secrets", Options{Doit: true, Jobs: 2})
+	}()
+	receive(t, "the watch", started)
+
+	watcher.Modify(drifted)
+	if reapplied := receive(t, "the re-apply", applies); string(reapplied.Data["PASSWORD"]) != "secret" {
+		t.Errorf("expected PASSWORD=secret to be re-applied, got %q", reapplied.Data["PASSWORD"])
+	}
+
+	cancel()
+	if err := receive(t, "the watch to stop", done); err != nil {
+		t.Errorf("watch failed: %v", err)
+	}
+}
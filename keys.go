@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// keyProvider obtains the SOPS age identity from a configured command or file
+// the command runs at most once per invocation, no matter how many files get decrypted
+// a file is read by sops itself on every decryption, so a rotated mounted key is picked up
+type keyProvider struct {
+	command string
+	file    string
+
+	once     sync.Once
+	identity []byte
+	err      error
+}
+
+// ageKeys is the key provider used for decryption, nil if none is configured
+var ageKeys *keyProvider
+
+// setKeyCommand configures the command used to obtain the age identity
+func setKeyCommand(command string) {
+	if command == "" {
+		ageKeys = nil
+		return
+	}
+	ageKeys = &keyProvider{command: command}
+}
+
+// setKeyFile configures a file holding the age identity, e.g. a mounted Kubernetes secret
+func setKeyFile(path string) {
+	if path == "" {
+		return
+	}
+	ageKeys = &keyProvider{file: path}
+}
+
+// Identity runs the key command on first use and returns the cached identity
+func (p *keyProvider) Identity() ([]byte, error) {
+	p.once.Do(func() {
+		cmd := exec.Command("sh", "-c", p.command)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			p.err = fmt.Errorf("key command %q failed: %w", p.command, err)
+			return
+		}
+
+		identity := bytes.TrimSpace(output)
+		if len(identity) == 0 {
+			p.err = fmt.Errorf("key command %q returned no identity", p.command)
+			return
+		}
+		p.identity = append(identity, '\n')
+	})
+	return p.identity, p.err
+}
+
+// attach hands the identity to a sops command through an inherited pipe
+// the key never shows up in the environment, only the path of the pipe or the key file does
+// the returned function must be called once the command has been started
+func (p *keyProvider) attach(cmd *exec.Cmd) (func(), error) {
+	// a file needs no pipe, sops reads it directly
+	if p.file != "" {
+		cmd.Env = append(withoutEnv(cmd.Env, "SOPS_AGE_KEY_FILE"), "SOPS_AGE_KEY_FILE="+p.file)
+		return func() {}, nil
+	}
+
+	identity, err := p.Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key pipe: %w", err)
+	}
+
+	// first entry of ExtraFiles becomes fd 3 in the child
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	fd := 2 + len(cmd.ExtraFiles)
+	cmd.Env = append(withoutEnv(cmd.Env, "SOPS_AGE_KEY_FILE"), fmt.Sprintf("SOPS_AGE_KEY_FILE=/dev/fd/%d", fd))
+
+	go func() {
+		defer w.Close()
+		_, _ = w.Write(identity)
+	}()
+
+	return func() { r.Close() }, nil
+}
+
+// withoutEnv removes a variable from an environment list
+func withoutEnv(env []string, name string) []string {
+	result := make([]string, 0, len(env))
+	for _, e := range env {
+		if !strings.HasPrefix(e, name+"=") {
+			result = append(result, e)
+		}
+	}
+	return result
+}
@@ -2,148 +2,560 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
-// secretWrite writes a secret to Kubernetes
-// creates the secret if it doesn't exist, updates it if it does
-func secretWrite(namespace, secretName, secretType string, values map[string]string) error {
-	config, err := getKubeConfig()
+// Kube is the Kubernetes access used by the commands
+// namespaces are local ones, implementations map them to the remote ones
+type Kube interface {
+	target() *kubeTarget
+	namespacePrefix() string
+	namespace(namespace string) string
+
+	getSecret(ctx context.Context, namespace, secretName string) (*corev1.Secret, error)
+	listSecrets(ctx context.Context, namespace, labelSelector string) ([]corev1.Secret, error)
+	secretWrite(ctx context.Context, namespace, secretName, secretType string, values map[string]string, meta managedMeta, live *corev1.Secret) error
+	secretDelete(ctx context.Context, namespace string, live *corev1.Secret) error
+	secretHistory(ctx context.Context, namespace, secretName string) ([]BackupEntry, error)
+	watchSecrets(ctx context.Context, namespace string) (watch.Interface, error)
+
+	getConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error)
+	listConfigMaps(ctx context.Context, namespace, labelSelector string) ([]corev1.ConfigMap, error)
+	configMapWrite(ctx context.Context, namespace, name string, values map[string]string, meta managedMeta, live *corev1.ConfigMap) error
+
+	namespaceExists(ctx context.Context, namespace string) (bool, error)
+	createNamespace(ctx context.Context, namespace string, labels map[string]string) error
+	canI(ctx context.Context, namespace, verb, resource string) (bool, error)
+
+	listWorkloads(ctx context.Context, namespace string) ([]Workload, error)
+	restartWorkload(ctx context.Context, namespace string, w Workload) error
+}
+
+// kubeClient implements Kube with a clientset shared by all operations of a run
+type kubeClient struct {
+	clientset      kubernetes.Interface
+	cluster        *kubeTarget   // context and cluster the client talks to
+	timeout        time.Duration // timeout for a single API request, 0 means none
+	prefix         string        // prepended to local namespaces to get the remote ones
+	forceConflicts bool          // take ownership of fields managed by others on apply
+	maxAttempts    int           // attempts for a single API request, including retries
+}
+
+// newKubeClient creates the client for this run
+func newKubeClient(opts Options) (*kubeClient, error) {
+	config, target, err := getKubeConfig(opts.Kubeconfig, opts.Context)
 	if err != nil {
-		return fmt.Errorf("error getting Kubernetes config: %w", err)
+		return nil, fmt.Errorf("error getting Kubernetes config: %w", err)
+	}
+
+	config.QPS = opts.QPS
+	config.Burst = opts.Burst
+
+	// impersonate to test what other roles may do
+	if opts.As != "" || len(opts.AsGroups) > 0 {
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: opts.As,
+			Groups:   opts.AsGroups,
+		}
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return fmt.Errorf("error creating Kubernetes client: %w", err)
+		return nil, fmt.Errorf("error creating Kubernetes client: %w", err)
+	}
+
+	return newKubeClientForClientset(clientset, target, opts), nil
+}
+
+// newKubeClientForClientset creates a client on top of an existing clientset
+func newKubeClientForClientset(clientset kubernetes.Interface, target *kubeTarget, opts Options) *kubeClient {
+	return &kubeClient{
+		clientset:      clientset,
+		cluster:        target,
+		timeout:        opts.Timeout,
+		prefix:         opts.NamespacePrefix,
+		forceConflicts: opts.ForceConflicts,
+		maxAttempts:    opts.MaxAttempts,
+	}
+}
+
+// target returns the context and cluster the client talks to
+func (k *kubeClient) target() *kubeTarget {
+	return k.cluster
+}
+
+// namespacePrefix returns the prefix of remote namespaces
+func (k *kubeClient) namespacePrefix() string {
+	return k.prefix
+}
+
+// namespace maps a local namespace to the remote one
+func (k *kubeClient) namespace(namespace string) string {
+	return k.prefix + namespace
+}
+
+// fieldManager is the field manager used for all writes
+const fieldManager = "kubesops"
+
+// deleteWaitTimeout bounds the wait for a deleted secret to be gone before it is created again
+const deleteWaitTimeout = time.Minute
+
+// errRemoteChanged is returned when a secret was modified after it was read
+var errRemoteChanged = errors.New("remote secret was changed since it was read")
+
+// isRemoteChanged reports whether err means the secret was modified concurrently
+func isRemoteChanged(err error) bool {
+	return errors.Is(err, errRemoteChanged)
+}
+
+// secretWrite writes a secret to Kubernetes using server-side apply as field manager kubesops
+// live is the current remote secret, a missing secret (nil) is created by the apply
+// the apply sets type, data and the labels and annotations in meta, fields of other managers are kept,
+// like their labels, annotations, owner references and finalizers
+// data keys kubesops applied before and that are missing in values are removed by the server,
+// keys owned by other field managers stay and are reported
+// an existing secret is only written if it still has the resourceVersion of live, otherwise errRemoteChanged is returned
+// the server reports conflicts with other field managers, forceConflicts takes their fields over
+// live is saved to the history before it is overwritten, a failed write may leave that entry behind,
+// a retry does not add it again as the history is keyed by resourceVersion
+// a live secret of another type is recreated, see secretRecreate
+func (k *kubeClient) secretWrite(ctx context.Context, namespace, secretName, secretType string, values map[string]string, meta managedMeta, live *corev1.Secret) error {
+	if live != nil && string(live.Type) != secretType {
+		return k.secretRecreate(ctx, namespace, secretName, secretType, values, meta, live)
+	}
+
+	secret := corev1ac.Secret(secretName, k.namespace(namespace))
+	if live != nil {
+		if err := k.saveBackup(ctx, namespace, live); err != nil {
+			return err
+		}
+		// only overwrite the version that was diffed
+		secret.WithResourceVersion(live.ResourceVersion)
+	}
+
+	applied, err := k.applySecret(ctx, secret, secretType, values, meta)
+	if err != nil {
+		return err
 	}
 
-	ctx := context.Background()
+	if live != nil {
+		printRemovedKeys("secret", secretName, applied.Namespace, secretStringData(live), secretStringData(applied), values)
+	}
 
+	return nil
+}
+
+// applySecret sets type, data and the metadata in meta on secret and applies it
+func (k *kubeClient) applySecret(ctx context.Context, secret *corev1ac.SecretApplyConfiguration, secretType string, values map[string]string, meta managedMeta) (*corev1.Secret, error) {
 	// convert map[string]string to map[string][]byte
-	secretData := make(map[string][]byte)
+	data := make(map[string][]byte)
 	for key, value := range values {
-		secretData[key] = []byte(value)
+		data[key] = []byte(value)
+	}
+
+	secret.WithType(corev1.SecretType(secretType)).
+		WithLabels(meta.Labels).
+		WithAnnotations(meta.Annotations).
+		WithData(data)
+
+	secrets := k.clientset.CoreV1().Secrets(*secret.Namespace)
+	var applied *corev1.Secret
+	err := k.doWrite(ctx, func(ctx context.Context) error {
+		var err error
+		applied, err = secrets.Apply(ctx, secret, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        k.forceConflicts,
+		})
+		return err
+	}, func(ctx context.Context) (bool, error) {
+		current, err := secrets.Get(ctx, *secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		applied = current
+		return string(current.Type) == secretType && hasValues(current.ObjectMeta, secretStringData(current), values, meta), nil
+	})
+	if err != nil {
+		return nil, applyError("secret", err)
+	}
+	fmt.Printf("Applied secret %s in namespace %s\n", applied.Name, applied.Namespace)
+
+	return applied, nil
+}
+
+// secretRecreate replaces a secret whose type changed, Kubernetes does not allow updating the type
+// the live secret is backed up first and deleted only if it is unchanged since it was read
+// the new secret is created once the old one is gone, finalizers may delay that up to deleteWaitTimeout
+// labels, annotations and owner references of the live secret are carried over
+func (k *kubeClient) secretRecreate(ctx context.Context, namespace, secretName, secretType string, values map[string]string, meta managedMeta, live *corev1.Secret) error {
+	if err := k.secretDelete(ctx, namespace, live); err != nil {
+		return err
 	}
 
-	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
-		},
-		Type: corev1.SecretType(secretType),
-		Data: secretData,
+	if err := k.waitSecretDeleted(ctx, namespace, live); err != nil {
+		return err
+	}
+
+	secret := corev1ac.Secret(secretName, k.namespace(namespace)).
+		WithLabels(live.Labels).
+		WithAnnotations(live.Annotations)
+	for _, ref := range live.OwnerReferences {
+		owner := metav1ac.OwnerReference().
+			WithAPIVersion(ref.APIVersion).
+			WithKind(ref.Kind).
+			WithName(ref.Name).
+			WithUID(ref.UID)
+		if ref.Controller != nil {
+			owner.WithController(*ref.Controller)
+		}
+		if ref.BlockOwnerDeletion != nil {
+			owner.WithBlockOwnerDeletion(*ref.BlockOwnerDeletion)
+		}
+		secret.WithOwnerReferences(owner)
 	}
 
-	// try to get existing secret
-	_, err = clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	_, err := k.applySecret(ctx, secret, secretType, values, meta)
+	return err
+}
 
+// secretDelete saves a live secret to the history and deletes it
+// the delete only succeeds if the secret is unchanged since it was read
+func (k *kubeClient) secretDelete(ctx context.Context, namespace string, live *corev1.Secret) error {
+	if err := k.saveBackup(ctx, namespace, live); err != nil {
+		return err
+	}
+
+	if err := k.deleteSecret(ctx, namespace, live); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted secret %s in namespace %s\n", live.Name, k.namespace(namespace))
+
+	return nil
+}
+
+// deleteSecret deletes a secret if it is still the object of live in the same version
+func (k *kubeClient) deleteSecret(ctx context.Context, namespace string, live *corev1.Secret) error {
+	err := k.do(ctx, func(ctx context.Context) error {
+		return k.clientset.CoreV1().Secrets(k.namespace(namespace)).Delete(ctx, live.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &live.UID, ResourceVersion: &live.ResourceVersion},
+		})
+	})
 	if err != nil {
-		// secret doesn't exist, create it
-		_, err = clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
-		if err != nil {
-			return fmt.Errorf("error creating secret: %w", err)
+		// already gone, e.g. a retried delete that went through the first time
+		if apierrors.IsNotFound(err) {
+			return nil
 		}
-		fmt.Printf("Created secret %s in namespace %s\n", secretName, namespace)
-	} else {
-		// secret exists, update it
-		_, err = clientset.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
-		if err != nil {
-			return fmt.Errorf("error updating secret: %w", err)
+		if apierrors.IsConflict(err) {
+			return errRemoteChanged
 		}
-		fmt.Printf("Updated secret %s in namespace %s\n", secretName, namespace)
+		return fmt.Errorf("error deleting secret: %w", err)
 	}
 
 	return nil
 }
 
-// secretRead reads a secret from Kubernetes
-func secretRead(namespace, secretName string) (map[string]string, error) {
-	config, err := getKubeConfig()
+// waitSecretDeleted waits until the deleted object of live is gone
+// a deleted secret stays while finalizers are pending, creating it again before fails
+// returns errRemoteChanged if someone else created the secret in the meantime
+func (k *kubeClient) waitSecretDeleted(ctx context.Context, namespace string, live *corev1.Secret) error {
+	waitCtx, cancel := context.WithTimeout(ctx, deleteWaitTimeout)
+	defer cancel()
+
+	delay := retryBaseDelay
+	for {
+		current, err := k.getSecret(waitCtx, namespace, live.Name)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if current.UID != live.UID {
+			return errRemoteChanged
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("secret %s is still terminating, pending finalizers: %s", live.Name, strings.Join(current.Finalizers, ", "))
+		}
+
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// printRemovedKeys reports the keys of live that an apply of values removed
+// keys that are still in applied are owned by other field managers, the apply kept them
+func printRemovedKeys(kind, name, namespace string, live, applied, values map[string]string) {
+	var removed, kept []string
+	for _, key := range removedKeys(live, values) {
+		if _, ok := applied[key]; ok {
+			kept = append(kept, key)
+		} else {
+			removed = append(removed, key)
+		}
+	}
+
+	if len(removed) > 0 {
+		fmt.Printf("Removed key(s) %s from %s %s in namespace %s\n", strings.Join(removed, ", "), kind, name, namespace)
+	}
+	if len(kept) > 0 {
+		fmt.Printf("warning: kept key(s) %s of %s %s in namespace %s, other field managers own them\n", strings.Join(kept, ", "), kind, name, namespace)
+	}
+}
+
+// removedKeys returns the sorted keys of live that are missing in values
+func removedKeys(live, values map[string]string) []string {
+	var keys []string
+	for key := range live {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hasValues reports whether an object has the data values and the labels and annotations in meta
+func hasValues(object metav1.ObjectMeta, data, values map[string]string, meta managedMeta) bool {
+	for key, value := range values {
+		if current, ok := data[key]; !ok || current != value {
+			return false
+		}
+	}
+	for key, value := range meta.Labels {
+		if current, ok := object.Labels[key]; !ok || current != value {
+			return false
+		}
+	}
+	for key, value := range meta.Annotations {
+		if current, ok := object.Annotations[key]; !ok || current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// writeError maps the error of a guarded create or update of an object of kind
+// a conflict or an object created in the meantime means it changed since it was read
+func writeError(kind string, err error) error {
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		return errRemoteChanged
+	}
+	return fmt.Errorf("error writing %s: %w", kind, err)
+}
+
+// applyError maps the error of a server-side apply of an object of kind
+// field manager conflicts are listed, a resourceVersion conflict means the object changed since it was read
+func applyError(kind string, err error) error {
+	if conflicts := fieldConflicts(err); conflicts != "" {
+		return fmt.Errorf("field ownership conflict, use -force-conflicts to take ownership:\n%s", conflicts)
+	}
+	if apierrors.IsConflict(err) {
+		return errRemoteChanged
+	}
+	return fmt.Errorf("error applying %s: %w", kind, err)
+}
+
+// fieldConflicts formats the field manager conflicts of a server-side apply error
+// returns an empty string if err is not such a conflict
+func fieldConflicts(err error) string {
+	var statusErr *apierrors.StatusError
+	if !apierrors.IsConflict(err) || !errors.As(err, &statusErr) || statusErr.ErrStatus.Details == nil {
+		return ""
+	}
+
+	var lines []string
+	for _, cause := range statusErr.ErrStatus.Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			lines = append(lines, fmt.Sprintf("  %s: %s", cause.Field, cause.Message))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// getSecret retrieves a secret object from Kubernetes
+func (k *kubeClient) getSecret(ctx context.Context, namespace, secretName string) (*corev1.Secret, error) {
+	var secret *corev1.Secret
+	err := k.do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = k.clientset.CoreV1().Secrets(k.namespace(namespace)).Get(ctx, secretName, metav1.GetOptions{})
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error getting Kubernetes config: %w", err)
+		return nil, fmt.Errorf("error reading secret: %w", err)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	return secret, nil
+}
+
+// listSecrets lists the secrets in a Kubernetes namespace
+// labelSelector restricts the result, empty lists all secrets
+func (k *kubeClient) listSecrets(ctx context.Context, namespace, labelSelector string) ([]corev1.Secret, error) {
+	var secretList *corev1.SecretList
+	err := k.do(ctx, func(ctx context.Context) error {
+		var err error
+		secretList, err = k.clientset.CoreV1().Secrets(k.namespace(namespace)).List(ctx, metav1.ListOptions{
+			LabelSelector: labelSelector,
+		})
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error creating Kubernetes client: %w", err)
+		return nil, fmt.Errorf("error listing secrets: %w", err)
 	}
 
-	ctx := context.Background()
+	return secretList.Items, nil
+}
 
-	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+// namespaceExists checks whether a namespace exists
+// returns true if the check is not allowed, the secret writes will tell
+func (k *kubeClient) namespaceExists(ctx context.Context, namespace string) (bool, error) {
+	err := k.do(ctx, func(ctx context.Context) error {
+		_, err := k.clientset.CoreV1().Namespaces().Get(ctx, k.namespace(namespace), metav1.GetOptions{})
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error reading secret: %w", err)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if apierrors.IsForbidden(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error reading namespace: %w", err)
+	}
+
+	return true, nil
+}
+
+// createNamespace creates a namespace with the given labels using server-side apply
+func (k *kubeClient) createNamespace(ctx context.Context, namespace string, labels map[string]string) error {
+	remoteNamespace := k.namespace(namespace)
+	ns := corev1ac.Namespace(remoteNamespace).WithLabels(labels)
+
+	err := k.do(ctx, func(ctx context.Context) error {
+		_, err := k.clientset.CoreV1().Namespaces().Apply(ctx, ns, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error creating namespace: %w", err)
 	}
+	fmt.Printf("Created namespace %s\n", remoteNamespace)
 
-	// convert map[string][]byte to map[string]string
+	return nil
+}
+
+// secretStringData converts map[string][]byte to map[string]string
+func secretStringData(secret *corev1.Secret) map[string]string {
 	result := make(map[string]string)
 	for key, value := range secret.Data {
 		result[key] = string(value)
 	}
+	return result
+}
 
-	return result, nil
+// kubeTarget describes the cluster a run talks to
+type kubeTarget struct {
+	Context string
+	Cluster string
+	Server  string
+}
+
+func (t *kubeTarget) String() string {
+	return fmt.Sprintf("context %s (cluster %s, server %s)", t.Context, t.Cluster, t.Server)
 }
 
 // getKubeConfig gets the Kubernetes configuration
 // priority order:
-//  1. In-cluster config
-//  2. KUBECONFIG env var (file path)
-//  3. KUBECONFIG_DATA env var (content)
+//  1. In-cluster config (unless -kubeconfig or -context is given)
+//  2. -kubeconfig flag (file path)
+//  3. KUBECONFIG env var (colon-separated list of files, merged)
 //  4. ~/.kube/config (default)
-func getKubeConfig() (*rest.Config, error) {
+//
+// KUBECONFIG_DATA (content) is merged in as an extra source, entries from files win
+func getKubeConfig(kubeconfigPath, contextName string) (*rest.Config, *kubeTarget, error) {
 	// try in-cluster config first
-	config, err := rest.InClusterConfig()
-	if err == nil {
-		return config, nil
+	if kubeconfigPath == "" && contextName == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, &kubeTarget{Context: "in-cluster", Cluster: "in-cluster", Server: config.Host}, nil
+		}
 	}
 
-	var kubeconfigData []byte
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfigPath
 
-	// check KUBECONFIG file path first
-	kubeconfigPath := os.Getenv("KUBECONFIG")
-	if kubeconfigPath != "" {
-		// try to read the kubeconfig file
-		kubeconfigData, err = os.ReadFile(kubeconfigPath)
+	rawConfig, err := rules.Load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading kubeconfig: %w", err)
+	}
+
+	if kubeconfigContent := os.Getenv("KUBECONFIG_DATA"); kubeconfigContent != "" {
+		extraConfig, err := clientcmd.Load([]byte(kubeconfigContent))
 		if err != nil {
-			// if KUBECONFIG is set but unreadable, fall back to KUBECONFIG_DATA
-			kubeconfigContent := os.Getenv("KUBECONFIG_DATA")
-			if kubeconfigContent != "" {
-				kubeconfigData = []byte(kubeconfigContent)
-			} else {
-				return nil, fmt.Errorf("error loading config file %q: %w", kubeconfigPath, err)
-			}
-		}
-	} else {
-		// KUBECONFIG not set, check KUBECONFIG_DATA
-		kubeconfigContent := os.Getenv("KUBECONFIG_DATA")
-		if kubeconfigContent != "" {
-			kubeconfigData = []byte(kubeconfigContent)
-		} else {
-			// fall back to default kubeconfig location
-			homeDir, err := os.UserHomeDir()
-			if err != nil {
-				return nil, fmt.Errorf("error getting user home directory: %w", err)
-			}
-			kubeconfigPath = homeDir + "/.kube/config"
-			kubeconfigData, err = os.ReadFile(kubeconfigPath)
-			if err != nil {
-				return nil, fmt.Errorf("error loading config file %q: %w", kubeconfigPath, err)
-			}
+			return nil, nil, fmt.Errorf("error loading KUBECONFIG_DATA: %w", err)
 		}
+		mergeKubeConfig(rawConfig, extraConfig)
 	}
 
-	config, err = clientcmd.RESTConfigFromKubeConfig(kubeconfigData)
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
+	clientConfig := clientcmd.NewDefaultClientConfig(*rawConfig, overrides)
+
+	config, err := clientConfig.ClientConfig()
 	if err != nil {
-		return nil, fmt.Errorf("error building kubeconfig: %w", err)
+		return nil, nil, fmt.Errorf("error building kubeconfig: %w", err)
+	}
+
+	target := &kubeTarget{Context: rawConfig.CurrentContext, Server: config.Host}
+	if contextName != "" {
+		target.Context = contextName
+	}
+	if kubeContext, ok := rawConfig.Contexts[target.Context]; ok {
+		target.Cluster = kubeContext.Cluster
 	}
 
-	return config, nil
+	return config, target, nil
+}
+
+// mergeKubeConfig adds entries from extra that are missing in config
+func mergeKubeConfig(config, extra *clientcmdapi.Config) {
+	for name, cluster := range extra.Clusters {
+		if _, ok := config.Clusters[name]; !ok {
+			config.Clusters[name] = cluster
+		}
+	}
+	for name, authInfo := range extra.AuthInfos {
+		if _, ok := config.AuthInfos[name]; !ok {
+			config.AuthInfos[name] = authInfo
+		}
+	}
+	for name, kubeContext := range extra.Contexts {
+		if _, ok := config.Contexts[name]; !ok {
+			config.Contexts[name] = kubeContext
+		}
+	}
+	if config.CurrentContext == "" {
+		config.CurrentContext = extra.CurrentContext
+	}
 }
@@ -1,16 +1,99 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// Options holds the command line options shared by all commands
+type Options struct {
+	Verbose bool          // show full values in diffs
+	Force   bool          // upload even if no changes detected
+	Doit    bool          // actually perform the upload
+	Jobs    int           // parallel workers for decryption and remote reads
+	Timeout time.Duration // timeout for a single API request
+	QPS     float32       // client side rate limit for API requests
+	Burst   int           // client side burst for API requests
+
+	MaxAttempts int // attempts for a single API request, including retries
+
+	Kubeconfig      string     // explicit kubeconfig file
+	Context         string     // kubeconfig context to use
+	NamespacePrefix string     // prepended to local namespaces to get the remote ones
+	As              string     // user to impersonate
+	AsGroups        stringList // groups to impersonate
+	ForceConflicts  bool       // take ownership of fields managed by others on apply
+	Adopt           bool       // take over existing secrets not managed by kubesops
+	Recreate        bool       // delete and recreate secrets whose type changed
+	Prune           bool       // delete managed remote secrets without a local file
+	Restart         bool       // rollout restart workloads using changed secrets
+	AllowBreaking   bool       // upload even if required workload references break
+
+	Names    stringList // globs selecting secrets by name
+	Types    stringList // types selecting secrets
+	Selector string     // label selector selecting remote secrets
+
+	Seal      string // sealing certificate, manifest prints SealedSecrets if set
+	SealScope string // strict, namespace-wide or cluster-wide
+
+	Interval time.Duration // time between syncs of reconcile
+	Listen   string        // address of the reconcile status server
+
+	CreateNamespaces bool              // create missing namespaces on upload
+	NamespaceLabels  map[string]string // labels for created namespaces
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	var opts Options
+	var qps float64
+
 	// Define flags
-	verbose := flag.Bool("verbose", false, "Verbose output (for diff command)")
-	force := flag.Bool("force", false, "Force upload even if no changes detected (for upload command)")
-	doit := flag.Bool("doit", false, "Actually perform the upload; default is dry-run (for upload command)")
+	flag.BoolVar(&opts.Verbose, "verbose", false, "Verbose output (for diff command)")
+	flag.BoolVar(&opts.Force, "force", false, "Force upload even if no changes detected (for upload command)")
+	flag.BoolVar(&opts.Doit, "doit", false, "Actually perform the upload; default is dry-run (for upload command)")
+	flag.IntVar(&opts.Jobs, "jobs", defaultJobs, "Number of parallel workers for decryption and remote reads")
+	flag.DurationVar(&opts.Timeout, "timeout", 30*time.Second, "Timeout for a single Kubernetes API request (0 disables)")
+	flag.Float64Var(&qps, "qps", 20, "Maximum Kubernetes API requests per second")
+	flag.IntVar(&opts.Burst, "burst", 40, "Maximum burst of Kubernetes API requests")
+	flag.IntVar(&opts.MaxAttempts, "max-attempts", 5, "Maximum attempts for a Kubernetes API request failing with a transient error")
+	flag.StringVar(&opts.Kubeconfig, "kubeconfig", "", "Path to the kubeconfig file (default: KUBECONFIG or ~/.kube/config)")
+	flag.StringVar(&opts.Context, "context", "", "Kubeconfig context to use (default: current context)")
+	flag.StringVar(&opts.NamespacePrefix, "namespace-prefix", "", "Prefix added to local namespaces to get the remote ones")
+	flag.StringVar(&opts.As, "as", "", "User to impersonate for Kubernetes API requests")
+	flag.Var(&opts.AsGroups, "as-group", "Group to impersonate for Kubernetes API requests (repeatable)")
+	flag.BoolVar(&opts.ForceConflicts, "force-conflicts", false, "Take ownership of fields managed by others (for upload command)")
+	flag.BoolVar(&opts.Adopt, "adopt", false, "Take over existing secrets not managed by kubesops (for upload and watch commands)")
+	flag.BoolVar(&opts.Recreate, "recreate", false, "Delete and recreate secrets whose type changed, after a backup (for upload command)")
+	flag.BoolVar(&opts.Prune, "prune", false, "Delete secrets managed by kubesops that have no local file, in namespaces with local files (for upload command)")
+	flag.BoolVar(&opts.Restart, "restart", false, "Rollout restart workloads using changed secrets (for upload command)")
+	flag.BoolVar(&opts.AllowBreaking, "allow-breaking", false, "Upload even if removed keys or pruned secrets are required by workloads (for upload command)")
+	flag.BoolVar(&opts.CreateNamespaces, "create-namespaces", false, "Create missing namespaces (for upload command)")
+	flag.Var(&opts.Names, "name", "Only secrets whose name matches this glob, repeatable (for download and diff commands)")
+	flag.Var(&opts.Types, "type", "Only secrets of this type, e.g. tls or Opaque, repeatable (for download and diff commands)")
+	flag.StringVar(&opts.Selector, "selector", "", "Only remote secrets matching this label selector (for download and diff commands)")
+	flag.StringVar(&opts.Seal, "seal", "", "Sealing certificate, print SealedSecrets instead of secrets (for manifest command)")
+	flag.StringVar(&opts.SealScope, "seal-scope", sealScopeStrict, "Scope of sealed secrets: strict, namespace-wide or cluster-wide (for manifest command)")
+	flag.DurationVar(&opts.Interval, "interval", time.Minute, "Time between syncs (for reconcile command)")
+	flag.StringVar(&opts.Listen, "listen", "127.0.0.1:8080", "Address for the health and status endpoints, e.g. :8080 for probes (for reconcile command)")
+	configPath := flag.String("config", defaultConfigPath, "Path to the kubesops config file")
 
 	// Custom usage message
 	flag.Usage = func() {
@@ -19,26 +102,52 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  upload [path]         Upload secrets to Kubernetes (default: secrets/)\n")
 		fmt.Fprintf(os.Stderr, "  download [path]       Download secrets from Kubernetes (default: secrets/)\n")
 		fmt.Fprintf(os.Stderr, "  diff [path1] [path2]  Compare secrets (1 path: local vs remote, 2 paths: local vs local)\n")
-		fmt.Fprintf(os.Stderr, "  manifest [path]       Print secrets as YAML manifests (default: secrets/)\n\n")
+		fmt.Fprintf(os.Stderr, "  manifest [path]       Print secrets as YAML manifests (default: secrets/)\n")
+		fmt.Fprintf(os.Stderr, "  watch [path]          Report remote secrets drifting from the local files (default: secrets/)\n")
+		fmt.Fprintf(os.Stderr, "  reconcile [path]      Apply secrets periodically like upload -doit (default: secrets/)\n")
+		fmt.Fprintf(os.Stderr, "  refs [path]           Show which workloads use each secret and key (default: secrets/)\n")
+		fmt.Fprintf(os.Stderr, "  rollback <ns>/<name> [-to N]  Restore a saved version of a secret (default: latest)\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s upload                                    # Upload all secrets (dry-run)\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -doit upload                              # Actually upload changed secrets\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -doit -force upload                       # Force upload all secrets\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -force-conflicts upload             # Upload and take over fields owned by others\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -adopt upload                       # Upload and take over secrets created by others\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -recreate upload                    # Upload and recreate secrets whose type changed\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -create-namespaces upload           # Upload and create missing namespaces\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -prune upload                             # Show managed secrets without a local file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -prune upload                       # Upload and delete them\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -restart upload                           # Show workloads that would be restarted\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -restart upload                     # Upload and restart them\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit -as ci -as-group deployers upload   # Check permissions of another role\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s upload secrets                            # Upload all secrets (dry-run)\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -doit upload secrets/test/dotenv.env      # Upload one secret\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s download                                  # Download all secrets\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s download secrets/test/dotenv.env          # Download one secret\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -selector team=api download secrets/test  # Download secrets labeled team=api\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s diff                                      # Diff all (local vs remote)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -name 'db-*' -type basic-auth diff        # Diff only matching secrets\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s diff secrets/test/dotenv.env              # Diff one (local vs remote)\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s diff secrets/live/db.env secrets/test/db.env # Diff two local files\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -verbose diff                             # Diff with full values\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -jobs 16 diff                             # Diff with 16 parallel workers\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -context staging diff                     # Diff against another cluster\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -namespace-prefix pr-42- diff             # Diff secrets/api against namespace pr-42-api\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s manifest                                  # Print all manifests\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s manifest secrets/test                     # Print manifests for test namespace\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -seal cert.pem manifest                   # Print SealedSecrets for GitOps\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s watch                                     # Report drift until Ctrl-C\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit watch secrets/live                  # Re-apply drifted secrets of live\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -interval 5m reconcile /git/repo/secrets  # Apply a synced checkout every 5 minutes\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s refs secrets/test                         # Show workloads using the secrets of test\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s rollback test/dotenv                      # Show saved versions and diff to the latest\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -doit rollback test/dotenv -to 3          # Restore version 3\n", os.Args[0])
 	}
 
 	flag.Parse()
+	opts.QPS = float32(qps)
 
 	// Get command
 	if flag.NArg() < 1 {
@@ -50,12 +159,24 @@ func main() {
 	command := flag.Arg(0)
 
 	// Validate command
-	if command != "upload" && command != "download" && command != "diff" && command != "manifest" {
+	commands := map[string]bool{"upload": true, "download": true, "diff": true, "manifest": true, "refs": true, "watch": true, "reconcile": true, "rollback": true}
+	if !commands[command] {
 		fmt.Fprintf(os.Stderr, "Error: invalid command '%s'\n\n", command)
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	// Load config
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	setKeyCommand(config.KeyCommand)
+	setKeyFile(config.KeyFile)
+	opts.CreateNamespaces = opts.CreateNamespaces || config.CreateNamespaces
+	opts.NamespaceLabels = config.NamespaceLabels
+
 	// Get path arguments with defaults
 	path1 := "secrets"
 	path2 := ""
@@ -67,30 +188,88 @@ func main() {
 		path2 = flag.Arg(2)
 	}
 
+	// Cancel on Ctrl-C, a second Ctrl-C kills the process
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Fprintf(os.Stderr, "\nInterrupted, stopping (press Ctrl-C again to abort)\n")
+		cancel()
+	}()
+
+	// Create one Kubernetes client for the whole run
+	var kube Kube
+	if command != "manifest" && !(command == "diff" && path2 != "") {
+		client, err := newKubeClient(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		kube = client
+	}
+
 	// Execute command
 	switch command {
 	case "upload":
-		if err := handleUpload(path1, *force, *doit, *verbose); err != nil {
+		if err := handleUpload(ctx, kube, path1, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Upload failed: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "download":
-		if err := handleDownload(path1); err != nil {
+		if err := handleDownload(ctx, kube, path1, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Download failed: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "diff":
-		if err := handleDiff(path1, path2, *verbose); err != nil {
+		if err := handleDiff(ctx, kube, path1, path2, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Diff failed: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "manifest":
-		if err := handleManifest(path1); err != nil {
+		if err := handleManifest(path1, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Manifest failed: %v\n", err)
 			os.Exit(1)
 		}
+
+	case "watch":
+		if err := handleWatch(ctx, kube, path1, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Watch failed: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "reconcile":
+		if err := handleReconcile(ctx, kube, path1, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Reconcile failed: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "refs":
+		if err := handleRefs(ctx, kube, path1, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Refs failed: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "rollback":
+		// rollback takes its own flags after the secret name
+		rollbackFlags := flag.NewFlagSet("rollback", flag.ExitOnError)
+		version := rollbackFlags.Int("to", 0, "Version to restore (default: latest saved version)")
+		if flag.NArg() > 2 {
+			rollbackFlags.Parse(flag.Args()[2:])
+		}
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Error: rollback needs <namespace>/<name>\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := handleRollback(ctx, kube, path1, *version, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// labels and annotations kubesops puts on the secrets it uploads
+const (
+	managedByLabel    = "app.kubernetes.io/managed-by"
+	managedByValue    = "kubesops"
+	sourceAnnotation  = "kubesops.vafer.org/source"
+	commitAnnotation  = "kubesops.vafer.org/commit"
+	hashAnnotation    = "kubesops.vafer.org/hash"
+	helmReleaseType   = "helm.sh/release.v1"
+	certManagerPrefix = "cert-manager.io/"
+)
+
+// managedMeta holds the labels and annotations kubesops owns on a secret
+type managedMeta struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// managedMetadata returns the ownership label and source annotations for an upload
+func managedMetadata(secret *Secret) managedMeta {
+	annotations := make(map[string]string)
+	if secret.Path != "" {
+		annotations[sourceAnnotation] = filepath.ToSlash(filepath.Clean(secret.Path))
+	}
+	dir := "."
+	if secret.Path != "" {
+		dir = filepath.Dir(secret.Path)
+	}
+	if commit := gitCommit(dir); commit != "" {
+		annotations[commitAnnotation] = commit
+	}
+	if secret.Hash != "" {
+		annotations[hashAnnotation] = secret.Hash
+	}
+
+	return managedMeta{
+		Labels:      map[string]string{managedByLabel: managedByValue},
+		Annotations: annotations,
+	}
+}
+
+// sourceHash returns the sha256 of the content of a file, as stored in the hash annotation
+// the values of an encrypted file can't be guessed from the hash of its ciphertext, ConfigMaps hold no secrets,
+// unencrypted secret files are not hashed as values with little entropy could be guessed
+func sourceHash(rawContent, kind string) string {
+	if kind != kindConfigMap && !isSOPSEncrypted(rawContent) {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(rawContent))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// contentHash returns a stable sha256 over the data of a secret, to compare data in memory
+// the hash is not stored, secret values with little entropy could be guessed from it
+func contentHash(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		// length prefixes keep "a"+"bc" and "ab"+"c" apart
+		value := data[key]
+		fmt.Fprintf(h, "%d:%s%d:%s", len(key), key, len(value), value)
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+var (
+	gitCommitMutex  sync.Mutex
+	gitCommitValues = make(map[string]string)
+)
+
+// gitCommit returns the commit checked out at dir, empty if not in a git repository
+// the result is cached per directory until resetGitCommits is called
+func gitCommit(dir string) string {
+	gitCommitMutex.Lock()
+	defer gitCommitMutex.Unlock()
+
+	commit, ok := gitCommitValues[dir]
+	if !ok {
+		output, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+		if err == nil {
+			commit = strings.TrimSpace(string(output))
+		}
+		gitCommitValues[dir] = commit
+	}
+	return commit
+}
+
+// resetGitCommits forgets the cached commits, e.g. after the checkout was updated
+func resetGitCommits() {
+	gitCommitMutex.Lock()
+	defer gitCommitMutex.Unlock()
+	gitCommitValues = make(map[string]string)
+}
+
+// isManaged reports whether a remote secret was uploaded by kubesops
+func isManaged(secret *corev1.Secret) bool {
+	return secret.Labels[managedByLabel] == managedByValue
+}
+
+// secretManager names what created a remote secret, empty if unknown
+func secretManager(secret *corev1.Secret) string {
+	if manager := secret.Labels[managedByLabel]; manager != "" {
+		return manager
+	}
+
+	switch secret.Type {
+	case corev1.SecretTypeServiceAccountToken:
+		return "service account"
+	case corev1.SecretTypeBootstrapToken:
+		return "bootstrap token"
+	case helmReleaseType:
+		return "Helm"
+	case historySecretType:
+		return "kubesops history"
+	}
+
+	for key := range secret.Annotations {
+		if strings.HasPrefix(key, certManagerPrefix) {
+			return "cert-manager"
+		}
+	}
+
+	if len(secret.OwnerReferences) > 0 {
+		return secret.OwnerReferences[0].Kind
+	}
+
+	return ""
+}
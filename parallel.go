@@ -0,0 +1,40 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// defaultJobs is the default number of parallel workers
+var defaultJobs = runtime.NumCPU()
+
+// forEachParallel calls fn for every index in [0, n) using at most jobs workers
+// results should be written to a slice indexed by i to keep ordering deterministic
+func forEachParallel(jobs, n int, fn func(i int)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > n {
+		jobs = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// represents a remote secret managed by kubesops that has no local file anymore
+type prunableSecret struct {
+	Namespace string         // local namespace
+	Secret    *corev1.Secret // remote secret
+}
+
+// findPrunable lists the managed secrets in the namespaces of secrets that have no local file
+// secrets without the kubesops ownership label are never returned, ConfigMaps are not pruned
+// namespaces without local files are not scanned, listing secrets across all namespaces
+// would need cluster-wide permissions that deploy roles usually don't have
+func findPrunable(ctx context.Context, kube Kube, secrets []*Secret) ([]prunableSecret, error) {
+	local := make(map[string]bool)
+	for _, secret := range secrets {
+		if !secret.IsConfigMap() {
+			local[secret.Namespace+"/"+secret.Name] = true
+		}
+	}
+
+	var prunable []prunableSecret
+	for _, namespace := range secretNamespaces(secrets) {
+		remoteSecrets, err := kube.listSecrets(ctx, namespace, managedByLabel+"="+managedByValue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list secrets in namespace %s: %w", kube.namespace(namespace), err)
+		}
+
+		for i := range remoteSecrets {
+			remote := &remoteSecrets[i]
+			if !isManaged(remote) || local[namespace+"/"+remote.Name] {
+				continue
+			}
+			prunable = append(prunable, prunableSecret{Namespace: namespace, Secret: remote})
+		}
+	}
+
+	return prunable, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// secretVerbs are the verbs shown in the permission matrix
+var secretVerbs = []string{"get", "list", "create", "update", "patch", "delete"}
+
+// configMapVerbs are the verbs configMapWrite needs, apply is a patch that creates missing ConfigMaps
+var configMapVerbs = []string{"get", "create", "patch"}
+
+// restartResources are the workloads -restart patches, as resource.group
+var restartResources = []string{"deployments.apps", "statefulsets.apps", "daemonsets.apps"}
+
+// workloadResources are the workloads listed to find references that an upload breaks
+var workloadResources = []string{"deployments.apps", "statefulsets.apps", "daemonsets.apps", "cronjobs.batch"}
+
+// canI asks the API server whether the current user may perform verb on resource in namespace
+// an empty namespace checks cluster-scoped resources like namespaces
+// resource may name its API group like kubectl does, e.g. deployments.apps
+func (k *kubeClient) canI(ctx context.Context, namespace, verb, resource string) (bool, error) {
+	if namespace != "" {
+		namespace = k.namespace(namespace)
+	}
+
+	name, group, _ := strings.Cut(resource, ".")
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     group,
+				Resource:  name,
+			},
+		},
+	}
+
+	var result *authorizationv1.SelfSubjectAccessReview
+	err := k.do(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = k.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("error checking permission to %s %s: %w", verb, resource, err)
+	}
+
+	return result.Status.Allowed, nil
+}
+
+// preflight lists what an upload needs to be allowed to do
+type preflight struct {
+	Namespaces       []string // local namespaces of the secrets
+	ConfigMaps       []string // local namespaces with ConfigMaps to write
+	Required         []string // verbs required on secrets, including the history secrets
+	CreateNamespaces bool     // namespaces to create require the permission to create namespaces
+	Restart          bool     // restarting workloads requires the permission to patch them
+	Workloads        []string // local namespaces whose workloads are listed for broken references
+}
+
+// preflightPermissions checks the permissions for every namespace and prints a matrix
+// returns an error listing every required permission that is missing
+// jobs is the number of checks running in parallel
+func preflightPermissions(ctx context.Context, kube Kube, p preflight, jobs int) error {
+	isRequired := make(map[string]bool)
+	for _, verb := range p.Required {
+		isRequired[verb] = true
+	}
+
+	var missing []string
+
+	// secret verbs per namespace
+	allowed, err := checkPermissions(ctx, kube, p.Namespaces, secretVerbs, func(verb string) (string, string) {
+		return verb, "secrets"
+	}, jobs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("permissions on secrets:\n")
+	missing = append(missing, printPermissions(kube, p.Namespaces, secretVerbs, allowed, func(verb string) string {
+		if isRequired[verb] {
+			return verb + " secrets"
+		}
+		return ""
+	})...)
+
+	// ConfigMaps are written next to the secrets
+	if len(p.ConfigMaps) > 0 {
+		allowed, err := checkPermissions(ctx, kube, p.ConfigMaps, configMapVerbs, func(verb string) (string, string) {
+			return verb, "configmaps"
+		}, jobs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("permissions on configmaps:\n")
+		missing = append(missing, printPermissions(kube, p.ConfigMaps, configMapVerbs, allowed, func(verb string) string {
+			return verb + " configmaps"
+		})...)
+	}
+
+	// -restart patches the workloads using changed secrets
+	if p.Restart {
+		allowed, err := checkPermissions(ctx, kube, p.Namespaces, restartResources, func(resource string) (string, string) {
+			return "patch", resource
+		}, jobs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("permissions to restart workloads (patch):\n")
+		missing = append(missing, printPermissions(kube, p.Namespaces, restartResources, allowed, func(resource string) string {
+			return "patch " + resource
+		})...)
+	}
+
+	// removed keys and pruned secrets are checked against the workloads referencing them
+	if len(p.Workloads) > 0 {
+		allowed, err := checkPermissions(ctx, kube, p.Workloads, workloadResources, func(resource string) (string, string) {
+			return "list", resource
+		}, jobs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("permissions to check workload references (list):\n")
+		missing = append(missing, printPermissions(kube, p.Workloads, workloadResources, allowed, func(resource string) string {
+			return "list " + resource
+		})...)
+	}
+
+	if p.CreateNamespaces {
+		ok, err := kube.canI(ctx, "", "create", "namespaces")
+		if err != nil {
+			return err
+		}
+		if ok {
+			fmt.Printf("create namespaces: yes\n")
+		} else {
+			fmt.Printf("create namespaces: NO\n")
+			missing = append(missing, "create namespaces")
+		}
+	}
+
+	fmt.Printf("\n")
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permission(s), nothing was changed:\n  %s", strings.Join(missing, "\n  "))
+	}
+
+	return nil
+}
+
+// checkPermissions asks for all cells of a namespace by column matrix in parallel
+// permission maps a column to the verb and resource to check
+func checkPermissions(ctx context.Context, kube Kube, namespaces, columns []string, permission func(column string) (string, string), jobs int) ([]bool, error) {
+	allowed := make([]bool, len(namespaces)*len(columns))
+	errs := make([]error, len(allowed))
+	forEachParallel(jobs, len(allowed), func(i int) {
+		verb, resource := permission(columns[i%len(columns)])
+		allowed[i], errs[i] = kube.canI(ctx, namespaces[i/len(columns)], verb, resource)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return allowed, nil
+}
+
+// printPermissions prints a namespace by column matrix in order
+// required returns the description of a required column, or an empty string
+// returns the required permissions that are missing
+func printPermissions(kube Kube, namespaces, columns []string, allowed []bool, required func(column string) string) []string {
+	var missing []string
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  namespace\t%s\n", strings.Join(columns, "\t"))
+	for n, namespace := range namespaces {
+		remoteNamespace := kube.namespace(namespace)
+		cells := make([]string, len(columns))
+		for c, column := range columns {
+			switch {
+			case allowed[n*len(columns)+c]:
+				cells[c] = "yes"
+			case required(column) != "":
+				cells[c] = "NO"
+				missing = append(missing, fmt.Sprintf("%s in %s", required(column), remoteNamespace))
+			default:
+				cells[c] = "no"
+			}
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", remoteNamespace, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+
+	return missing
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// backoff between attempts of an API request, doubled after each attempt
+const (
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// do runs a single API request with the per request timeout
+// transient failures are retried with exponential backoff and jitter up to maxAttempts
+func (k *kubeClient) do(ctx context.Context, request func(ctx context.Context) error) error {
+	delay := retryBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		err := k.attempt(ctx, request)
+		if err == nil || attempt >= k.maxAttempts || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		countRetry(ctx)
+
+		// the server may ask for a longer delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		if seconds, ok := apierrors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// doWrite runs a create or a write guarded by a resourceVersion, transient failures are retried like in do
+// after a timeout or a server error the previous attempt may have gone through,
+// the retry then fails as a conflict or because the object already exists
+// in that case written re-reads the object and reports whether it is in the state the write leaves it,
+// that counts as success
+func (k *kubeClient) doWrite(ctx context.Context, request func(ctx context.Context) error, written func(ctx context.Context) (bool, error)) error {
+	attempts := 0
+	err := k.do(ctx, func(ctx context.Context) error {
+		attempts++
+		return request(ctx)
+	})
+	if attempts > 1 && (apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) {
+		if ok, readErr := written(ctx); readErr == nil && ok {
+			return nil
+		}
+	}
+	return err
+}
+
+// attempt runs a request once, bounded by the per request timeout
+func (k *kubeClient) attempt(ctx context.Context, request func(ctx context.Context) error) error {
+	if k.timeout <= 0 {
+		return request(ctx)
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, k.timeout)
+	defer cancel()
+	return request(reqCtx)
+}
+
+// isRetryable classifies errors of API requests
+// transient failures are retryable, everything else is permanent
+func isRetryable(err error) bool {
+	switch {
+	case apierrors.IsTooManyRequests(err),
+		apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsInternalError(err),
+		apierrors.IsServiceUnavailable(err),
+		apierrors.IsUnexpectedServerError(err):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		// the per request timeout, the caller's context is checked separately
+		return true
+	case utilnet.IsConnectionReset(err), utilnet.IsConnectionRefused(err), utilnet.IsProbableEOF(err):
+		return true
+	}
+
+	// etcd hiccups surface as plain errors in some API server versions
+	message := err.Error()
+	return strings.Contains(message, "etcdserver: leader changed") ||
+		strings.Contains(message, "etcdserver: request timed out")
+}
+
+// retryCounter counts the retries of all requests made with a context
+type retryCounter struct {
+	retries atomic.Int32
+}
+
+type retryCounterKey struct{}
+
+// withRetryCounter returns a context that counts the retries of requests made with it
+func withRetryCounter(ctx context.Context) (context.Context, *retryCounter) {
+	counter := &retryCounter{}
+	return context.WithValue(ctx, retryCounterKey{}, counter), counter
+}
+
+// countRetry records a retry in the counter of ctx, if any
+func countRetry(ctx context.Context) {
+	if counter, ok := ctx.Value(retryCounterKey{}).(*retryCounter); ok {
+		counter.retries.Add(1)
+	}
+}
+
+// Retries returns the number of retries so far
+func (c *retryCounter) Retries() int {
+	return int(c.retries.Load())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestIsRetryable(t *testing.T) {
+	resource := schema.GroupResource{Resource: "secrets"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many requests", apierrors.NewTooManyRequests("slow down", 1), true},
+		{"internal error", apierrors.NewInternalError(errors.New("boom")), true},
+		{"service unavailable", apierrors.NewServiceUnavailable("unavailable"), true},
+		{"server timeout", apierrors.NewServerTimeout(resource, "get", 1), true},
+		{"request timeout", fmt.Errorf("error reading secret: %w", context.DeadlineExceeded), true},
+		{"etcd leader changed", errors.New("etcdserver: leader changed"), true},
+		{"not found", apierrors.NewNotFound(resource, "db"), false},
+		{"forbidden", apierrors.NewForbidden(resource, "db", errors.New("denied")), false},
+		{"conflict", apierrors.NewConflict(resource, "db", errors.New("modified")), false},
+		{"invalid", apierrors.NewBadRequest("invalid"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoWrite(t *testing.T) {
+	resource := schema.GroupResource{Resource: "secrets"}
+	conflict := apierrors.NewConflict(resource, "db", errors.New("modified"))
+	exists := apierrors.NewAlreadyExists(resource, "db")
+
+	tests := []struct {
+		name    string
+		errs    []error // results of the attempts
+		written bool    // whether the object is in the written state when re-read
+		want    error
+	}{
+		{"internal error", []error{apierrors.NewInternalError(errors.New("boom")), nil}, false, nil},
+		{"etcd leader changed", []error{errors.New("etcdserver: leader changed"), nil}, false, nil},
+		{"server timeout, went through", []error{apierrors.NewServerTimeout(resource, "patch", 1), conflict}, true, nil},
+		{"request timeout, went through", []error{fmt.Errorf("error writing secret: %w", context.DeadlineExceeded), exists}, true, nil},
+		{"server timeout, changed by others", []error{apierrors.NewServerTimeout(resource, "patch", 1), conflict}, false, conflict},
+		{"conflict", []error{conflict}, true, conflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &kubeClient{maxAttempts: 3}
+			attempts := 0
+			err := k.doWrite(context.Background(), func(ctx context.Context) error {
+				attempts++
+				return tt.errs[attempts-1]
+			}, func(ctx context.Context) (bool, error) {
+				return tt.written, nil
+			})
+			if err != tt.want || attempts != len(tt.errs) {
+				t.Errorf("got %v after %d attempt(s), want %v after %d", err, attempts, tt.want, len(tt.errs))
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+)
+
+// scopes of sealed secrets, they decide which names a sealed value may be decrypted for
+const (
+	sealScopeStrict        = "strict"         // bound to namespace and name
+	sealScopeNamespaceWide = "namespace-wide" // may be renamed within the namespace
+	sealScopeClusterWide   = "cluster-wide"   // may be used under any namespace and name
+)
+
+// annotations the sealed-secrets controller reads to relax the scope
+const (
+	namespaceWideAnnotation = "sealedsecrets.bitnami.com/namespace-wide"
+	clusterWideAnnotation   = "sealedsecrets.bitnami.com/cluster-wide"
+)
+
+// size of the AES-256 session key of the hybrid encryption
+const sealSessionKeyBytes = 32
+
+// loadSealingCert reads the public key from a sealing certificate as printed by kubeseal --fetch-cert
+func loadSealingCert(path string) (*rsa.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sealing certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sealing certificate %s: %w", path, err)
+	}
+
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("sealing certificate %s has no RSA public key", path)
+	}
+
+	return publicKey, nil
+}
+
+// validSealScope reports whether scope is one of the sealed secret scopes
+func validSealScope(scope string) bool {
+	switch scope {
+	case sealScopeStrict, sealScopeNamespaceWide, sealScopeClusterWide:
+		return true
+	}
+	return false
+}
+
+// sealingLabel returns the label a value is encrypted with, it binds the value to the scope
+func sealingLabel(scope, namespace, name string) []byte {
+	switch scope {
+	case sealScopeClusterWide:
+		return []byte{}
+	case sealScopeNamespaceWide:
+		return []byte(namespace)
+	default:
+		return []byte(namespace + "/" + name)
+	}
+}
+
+// sealAnnotation returns the annotation marking a relaxed scope, empty for strict
+func sealAnnotation(scope string) string {
+	switch scope {
+	case sealScopeNamespaceWide:
+		return namespaceWideAnnotation
+	case sealScopeClusterWide:
+		return clusterWideAnnotation
+	}
+	return ""
+}
+
+// sealValue encrypts a value for the sealed-secrets controller, base64 encoded
+func sealValue(publicKey *rsa.PublicKey, scope, namespace, name, value string) (string, error) {
+	ciphertext, err := hybridEncrypt(rand.Reader, publicKey, []byte(value), sealingLabel(scope, namespace, name))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// hybridEncrypt encrypts plaintext the way kubeseal does
+// a random AES-GCM session key encrypts the data and is itself encrypted with RSA-OAEP using label
+// the result is the 2 byte length of the RSA ciphertext, the RSA ciphertext and the AES-GCM ciphertext
+// the session key is used only once, so the GCM nonce is all zeros
+func hybridEncrypt(random io.Reader, publicKey *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, sealSessionKeyBytes)
+	if _, err := io.ReadFull(random, sessionKey); err != nil {
+		return nil, fmt.Errorf("failed to create session key: %w", err)
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), random, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt session key: %w", err)
+	}
+
+	ciphertext := binary.BigEndian.AppendUint16(nil, uint16(len(rsaCiphertext)))
+	ciphertext = append(ciphertext, rsaCiphertext...)
+
+	zeroNonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ciphertext, zeroNonce, plaintext, nil), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hybridDecrypt is the controller side of hybridEncrypt, like HybridDecrypt of sealed-secrets
+func hybridDecrypt(t *testing.T, privateKey *rsa.PrivateKey, ciphertext, label []byte) ([]byte, error) {
+	t.Helper()
+
+	if len(ciphertext) < 2 {
+		return nil, errors.New("ciphertext too short")
+	}
+	rsaLen := int(binary.BigEndian.Uint16(ciphertext))
+	if len(ciphertext) < 2+rsaLen {
+		return nil, errors.New("ciphertext too short")
+	}
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertext[2:2+rsaLen], label)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext[2+rsaLen:], nil)
+}
+
+func TestSealValue(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a self-signed sealing certificate like the controller creates
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sealed-secret"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := loadSealingCert(certPath)
+	if err != nil {
+		t.Fatalf("loadSealingCert failed: %v", err)
+	}
+
+	tests := []struct {
+		scope string
+		label string
+	}{
+		{sealScopeStrict, "test/db"},
+		{sealScopeNamespaceWide, "test"},
+		{sealScopeClusterWide, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			sealed, err := sealValue(publicKey, tt.scope, "test", "db", "secret")
+			if err != nil {
+				t.Fatalf("sealValue failed: %v", err)
+			}
+			ciphertext, err := base64.StdEncoding.DecodeString(sealed)
+			if err != nil {
+				t.Fatalf("invalid base64: %v", err)
+			}
+
+			plaintext, err := hybridDecrypt(t, privateKey, ciphertext, []byte(tt.label))
+			if err != nil {
+				t.Fatalf("decrypt failed: %v", err)
+			}
+			if string(plaintext) != "secret" {
+				t.Errorf("expected secret, got %q", plaintext)
+			}
+
+			// the value can't be moved to another namespace
+			if tt.scope != sealScopeClusterWide {
+				if _, err := hybridDecrypt(t, privateKey, ciphertext, []byte("other/db")); err == nil {
+					t.Errorf("expected decryption with another label to fail")
+				}
+			}
+		})
+	}
+}
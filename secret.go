@@ -10,12 +10,25 @@ import (
 	"strings"
 )
 
-// represents a Kubernetes secret
+// kinds of objects a file can describe
+const (
+	kindSecret    = "Secret"
+	kindConfigMap = "ConfigMap"
+)
+
+// configMapSuffix marks files holding a ConfigMap instead of a secret
+const configMapSuffix = ".config.env"
+
+// represents a Kubernetes secret, or a ConfigMap for non-sensitive configuration
 type Secret struct {
 	Namespace string            // Kubernetes namespace
 	Name      string            // Secret name
-	Type      string            // Kubernetes secret type
+	Kind      string            // Secret or ConfigMap
+	Type      string            // Kubernetes secret type, empty for ConfigMaps
 	Data      map[string]string // Key-value pairs
+	Plaintext map[string]bool   // Keys left unencrypted in a SOPS-encrypted file
+	Path      string            // File the secret was loaded from
+	Hash      string            // sha256 of the file, empty for unencrypted secrets
 }
 
 // loads a secret from a file
@@ -29,11 +42,10 @@ func LoadSecretFile(filePath string) (*Secret, error) {
 	}
 
 	namespace := parts[len(parts)-2]
-	secretNameWithExt := parts[len(parts)-1]
-	secretName := strings.TrimSuffix(secretNameWithExt, filepath.Ext(secretNameWithExt))
+	secretName, kind := nameAndKind(parts[len(parts)-1])
 
 	// read file content (with SOPS decryption if needed)
-	content, err := readFileWithSOPS(filePath)
+	content, rawContent, err := readFileWithSOPS(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
 	}
@@ -47,20 +59,64 @@ func LoadSecretFile(filePath string) (*Secret, error) {
 	// perform env var substitution
 	data = substituteEnvVars(data)
 
+	// find the keys that are readable in the encrypted file
+	plaintext, err := plaintextKeys(rawContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file %s: %w", filePath, err)
+	}
+
+	if headerKind := extractKind(content); headerKind != "" {
+		if headerKind != kindSecret && headerKind != kindConfigMap {
+			return nil, fmt.Errorf("failed to parse file %s: unknown kind %s", filePath, headerKind)
+		}
+		kind = headerKind
+	}
+
+	// ConfigMaps are not sensitive, all their values are shown in full
+	if kind == kindConfigMap {
+		if secretType != "Opaque" {
+			return nil, fmt.Errorf("failed to parse file %s: a ConfigMap has no type, got %s", filePath, secretType)
+		}
+		secretType = ""
+		plaintext = make(map[string]bool)
+		for key := range data {
+			plaintext[key] = true
+		}
+	}
+
 	return &Secret{
 		Namespace: namespace,
 		Name:      secretName,
+		Kind:      kind,
 		Type:      secretType,
 		Data:      data,
+		Plaintext: plaintext,
+		Path:      filePath,
+		Hash:      sourceHash(rawContent, kind),
 	}, nil
 }
 
+// nameAndKind derives the object name and kind from a file name
+// "app.env" is the secret app, "app.config.env" the ConfigMap app
+func nameAndKind(fileName string) (string, string) {
+	if strings.HasSuffix(fileName, configMapSuffix) {
+		return strings.TrimSuffix(fileName, configMapSuffix), kindConfigMap
+	}
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)), kindSecret
+}
+
+// IsConfigMap reports whether the file describes a ConfigMap
+func (s *Secret) IsConfigMap() bool {
+	return s.Kind == kindConfigMap
+}
+
 // readFileWithSOPS reads a file and decrypts it with SOPS if needed
-func readFileWithSOPS(filePath string) (string, error) {
+// returns the decrypted content and the raw content of the file
+func readFileWithSOPS(filePath string) (string, string, error) {
 	// first, try to read the file to check if it's SOPS-encrypted
 	rawContent, err := os.ReadFile(filePath)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// check if file is SOPS-encrypted by looking for SOPS metadata
@@ -71,15 +127,51 @@ func readFileWithSOPS(filePath string) (string, error) {
 		// pass through SOPS_AGE_KEY environment variable if set
 		cmd.Env = os.Environ()
 
+		// hand over the identity from the key command if configured
+		if ageKeys != nil {
+			release, err := ageKeys.attach(cmd)
+			if err != nil {
+				return "", "", err
+			}
+			defer release()
+		}
+
 		output, err := cmd.CombinedOutput()
 		if err != nil {
-			return "", fmt.Errorf("SOPS decryption failed: %w\nOutput: %s", err, string(output))
+			return "", "", fmt.Errorf("SOPS decryption failed: %w\nOutput: %s", err, string(output))
 		}
-		return string(output), nil
+		return string(output), string(rawContent), nil
 	}
 
 	// not encrypted, return as-is
-	return string(rawContent), nil
+	return string(rawContent), string(rawContent), nil
+}
+
+// plaintextKeys returns the keys of a SOPS-encrypted file whose values are not encrypted
+// (e.g. excluded via encrypted_regex or unencrypted_suffix)
+// returns nil for files that are not SOPS-encrypted at all
+func plaintextKeys(rawContent string) (map[string]bool, error) {
+	if !isSOPSEncrypted(rawContent) {
+		return nil, nil
+	}
+
+	data, _, err := parseSecretContent(rawContent)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make(map[string]bool)
+	for key, value := range data {
+		// skip SOPS metadata
+		if strings.HasPrefix(key, "sops_") {
+			continue
+		}
+		if !strings.HasPrefix(value, "ENC[") {
+			plaintext[key] = true
+		}
+	}
+
+	return plaintext, nil
 }
 
 // isSOPSEncrypted checks if content is SOPS-encrypted
@@ -95,6 +187,11 @@ func parseSecretContent(content string) (map[string]string, string, error) {
 	data := make(map[string]string)
 	secretType := "Opaque" // Default type
 
+	// the type comment is part of the header
+	if _, headerType := headerComments(content); headerType != "" {
+		secretType = headerType
+	}
+
 	scanner := bufio.NewScanner(strings.NewReader(content))
 	lineNum := 0
 
@@ -103,14 +200,6 @@ func parseSecretContent(content string) (map[string]string, string, error) {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
 
-		// check first line for type comment
-		if lineNum == 1 && strings.HasPrefix(line, "#") {
-			if typeMatch := extractTypeFromComment(line); typeMatch != "" {
-				secretType = typeMatch
-				continue
-			}
-		}
-
 		// skip empty lines and comments
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
@@ -157,6 +246,48 @@ func extractTypeFromComment(line string) string {
 	return ""
 }
 
+// extractKindFromComment extracts the object kind from a comment
+// example: "# kind=ConfigMap" returns "ConfigMap"
+func extractKindFromComment(line string) string {
+	re := regexp.MustCompile(`^#\s*kind\s*=\s*(\S+)`)
+	matches := re.FindStringSubmatch(line)
+	if len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
+
+// headerComments returns the kind and type comments of the header, empty if missing
+// the header are the comment lines at the start of content, kind and type may come in any order
+func headerComments(content string) (string, string) {
+	kind, secretType := "", ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if kind == "" {
+			kind = extractKindFromComment(line)
+		}
+		if secretType == "" {
+			secretType = extractTypeFromComment(line)
+		}
+	}
+	return kind, secretType
+}
+
+// extractKind returns the kind given in the header of content, empty if none
+func extractKind(content string) string {
+	switch kind, _ := headerComments(content); strings.ToLower(kind) {
+	case "configmap":
+		return kindConfigMap
+	case "secret":
+		return kindSecret
+	default:
+		return kind
+	}
+}
+
 // mapSecretType maps common type aliases to full Kubernetes type names
 func mapSecretType(secretType string) string {
 	switch secretType {
@@ -189,7 +320,8 @@ func substituteEnvVars(data map[string]string) map[string]string {
 }
 
 // loads all secrets from a path (file or directory)
-func LoadSecretsFromPath(path string) ([]*Secret, error) {
+// files are decrypted with up to jobs parallel workers, results keep the walk order
+func LoadSecretsFromPath(path string, jobs int) ([]*Secret, error) {
 	// Default to "secrets" if no path provided
 	if path == "" {
 		path = "secrets"
@@ -223,19 +355,23 @@ func LoadSecretsFromPath(path string) ([]*Secret, error) {
 	}
 
 	// load all secret files
-	var secrets []*Secret
-	for _, file := range files {
-		secret, err := LoadSecretFile(file)
+	secrets := make([]*Secret, len(files))
+	errs := make([]error, len(files))
+	forEachParallel(jobs, len(files), func(i int) {
+		secrets[i], errs[i] = LoadSecretFile(files[i])
+	})
+
+	// report the first error in walk order
+	for i, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("failed to load %s: %w", file, err)
+			return nil, fmt.Errorf("failed to load %s: %w", files[i], err)
 		}
-		secrets = append(secrets, secret)
 	}
 
 	return secrets, nil
 }
 
-// writes a secret to a file
+// writes a secret to a file, an empty secretType writes a ConfigMap
 // only writes static values (no env var references)
 func WriteSecretFile(filePath string, secretType string, data map[string]string) error {
 	// create directory if it doesn't exist
@@ -253,8 +389,14 @@ func WriteSecretFile(filePath string, secretType string, data map[string]string)
 	writer := bufio.NewWriter(file)
 	defer writer.Flush()
 
-	// write type comment if not generic/opaque
-	if secretType != "Opaque" && secretType != "generic" {
+	// ConfigMaps have no type, files not named *.config.env need the kind comment
+	if secretType == "" {
+		if !strings.HasSuffix(filePath, configMapSuffix) {
+			if _, err := fmt.Fprintf(writer, "# kind=%s\n", kindConfigMap); err != nil {
+				return fmt.Errorf("failed to write kind comment: %w", err)
+			}
+		}
+	} else if secretType != "Opaque" && secretType != "generic" {
 		// map back to alias if possible
 		typeAlias := secretType
 		switch secretType {
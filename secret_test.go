@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlaintextKeys(t *testing.T) {
+	content := `DB_HOST=db.internal
+DB_PASSWORD=ENC[AES256_GCM,data:Zm9v,iv:YmFy,tag:YmF6,type:str]
+LOG_LEVEL=debug
+sops_version=3.9.0
+sops_mac=ENC[AES256_GCM,data:Zm9v,iv:YmFy,tag:YmF6,type:str]
+`
+
+	plaintext, err := plaintextKeys(content)
+	if err != nil {
+		t.Fatalf("plaintextKeys failed: %v", err)
+	}
+
+	expected := map[string]bool{
+		"DB_HOST":   true,
+		"LOG_LEVEL": true,
+	}
+
+	if len(plaintext) != len(expected) {
+		t.Fatalf("expected %d plaintext keys, got %v", len(expected), plaintext)
+	}
+	for key := range expected {
+		if !plaintext[key] {
+			t.Errorf("expected %s to be plaintext", key)
+		}
+	}
+}
+
+func TestPlaintextKeys_NotEncrypted(t *testing.T) {
+	plaintext, err := plaintextKeys("DB_HOST=db.internal\n")
+	if err != nil {
+		t.Fatalf("plaintextKeys failed: %v", err)
+	}
+	if plaintext != nil {
+		t.Errorf("expected nil for unencrypted file, got %v", plaintext)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	long := "abcdefghijklmnop"
+
+	if got := formatValue(long, true, false, false); got != "[abcdefghij...]" {
+		t.Errorf("expected truncated value, got %s", got)
+	}
+	if got := formatValue(long, true, true, false); got != "["+long+"]" {
+		t.Errorf("expected full plaintext value, got %s", got)
+	}
+	if got := formatValue(long, false, true, false); got != "missing" {
+		t.Errorf("expected missing, got %s", got)
+	}
+}
+
+func TestLoadSecretFileKind(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		file    string
+		content string
+		name    string
+		kind    string
+		typ     string
+	}{
+		{"app.env", "KEY=value\n", "app", kindSecret, "Opaque"},
+		{"app.config.env", "KEY=value\n", "app", kindConfigMap, ""},
+		{"flags.env", "# kind=ConfigMap\nKEY=value\n", "flags", kindConfigMap, ""},
+		{"auth.env", "# kind=Secret\n# type=basic-auth\nusername=admin\n", "auth", kindSecret, "kubernetes.io/basic-auth"},
+		{"login.env", "# type=basic-auth\n# kind=Secret\nusername=admin\n", "login", kindSecret, "kubernetes.io/basic-auth"},
+		{"generic.env", "# type=generic\n# kind=ConfigMap\nKEY=value\n", "generic", kindConfigMap, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(dir, "test", tt.file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			secret, err := LoadSecretFile(path)
+			if err != nil {
+				t.Fatalf("LoadSecretFile failed: %v", err)
+			}
+			if secret.Name != tt.name || secret.Kind != tt.kind || secret.Type != tt.typ {
+				t.Errorf("got %s %s %q, want %s %s %q", secret.Name, secret.Kind, secret.Type, tt.name, tt.kind, tt.typ)
+			}
+			if secret.IsConfigMap() && !secret.Plaintext["KEY"] {
+				t.Errorf("expected ConfigMap values to be plaintext")
+			}
+		})
+	}
+}
+
+func TestLoadSecretFileConfigMapWithType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test", "flags.env")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("# type=tls\n# kind=ConfigMap\nKEY=value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the kind is found after the type, the type does not fit a ConfigMap
+	if _, err := LoadSecretFile(path); err == nil || !strings.Contains(err.Error(), "a ConfigMap has no type") {
+		t.Errorf("expected a ConfigMap with a type to be rejected, got %v", err)
+	}
+}
+
+func TestSourceHash(t *testing.T) {
+	encrypted := "PASSWORD=ENC[AES256_GCM,data:Zm9v,iv:YmFy,tag:YmF6,type:str]\nsops_version=3.9.0\n"
+
+	if hash := sourceHash(encrypted, kindSecret); !strings.HasPrefix(hash, "sha256:") || hash == sourceHash(encrypted+"\n", kindSecret) {
+		t.Errorf("expected the hash of the encrypted file, got %q", hash)
+	}
+	if hash := sourceHash("LOG_LEVEL=debug\n", kindConfigMap); hash == "" {
+		t.Errorf("expected ConfigMaps to be hashed")
+	}
+	// the hash of a plaintext secret would reveal values with little entropy
+	if hash := sourceHash("PASSWORD=1234\n", kindSecret); hash != "" {
+		t.Errorf("expected no hash of an unencrypted secret, got %q", hash)
+	}
+}
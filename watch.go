@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// delay before a failed watch is restarted
+const watchRestartDelay = 5 * time.Second
+
+// represents a change of a secret or a failure while watching a namespace
+type secretEvent struct {
+	Namespace string // local namespace
+	Type      watch.EventType
+	Secret    *corev1.Secret
+	Err       error
+}
+
+// watchSecrets watches the secrets in a namespace
+// the watch starts with an ADDED event for every existing secret
+// it runs until ctx is done or the server closes it, so it is not bound by the request timeout
+func (k *kubeClient) watchSecrets(ctx context.Context, namespace string) (watch.Interface, error) {
+	w, err := k.clientset.CoreV1().Secrets(k.namespace(namespace)).Watch(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error watching secrets: %w", err)
+	}
+	return w, nil
+}
+
+// watchNamespace sends the secret events of a namespace until ctx is done
+// the watch is restarted whenever the server closes it or it fails, after watchRestartDelay
+// so a watch that keeps failing right away does not hammer the API server
+func watchNamespace(ctx context.Context, kube Kube, namespace string, events chan<- secretEvent) {
+	send := func(event secretEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for ctx.Err() == nil {
+		w, err := kube.watchSecrets(ctx, namespace)
+		if err != nil {
+			if !send(secretEvent{Namespace: namespace, Err: err}) {
+				return
+			}
+		} else {
+			for event := range w.ResultChan() {
+				if event.Type == watch.Error {
+					// e.g. an expired resourceVersion, the watch is restarted from the current state
+					send(secretEvent{Namespace: namespace, Err: fmt.Errorf("watch failed: %w", apierrors.FromObject(event.Object))})
+					break
+				}
+				secret, ok := event.Object.(*corev1.Secret)
+				if !ok {
+					continue
+				}
+				if !send(secretEvent{Namespace: namespace, Type: event.Type, Secret: secret}) {
+					break
+				}
+			}
+			w.Stop()
+		}
+
+		select {
+		case <-time.After(watchRestartDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// lastManager returns the field manager that most recently changed a secret according to its managedFields
+func lastManager(secret *corev1.Secret) string {
+	var last *metav1.ManagedFieldsEntry
+	for i := range secret.ManagedFields {
+		entry := &secret.ManagedFields[i]
+		if entry.Time == nil {
+			continue
+		}
+		if last == nil || entry.Time.After(last.Time.Time) {
+			last = entry
+		}
+	}
+
+	if last == nil {
+		return "an unknown manager"
+	}
+	return fmt.Sprintf("%s (%s at %s)", last.Manager, last.Operation, last.Time.Format(time.RFC3339))
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// restartedAtAnnotation is the pod template annotation kubectl uses for rollout restarts
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// represents a workload with a pod template
+type Workload struct {
+	Kind     string // Deployment, StatefulSet, DaemonSet, CronJob
+	Name     string
+	Template *corev1.PodTemplateSpec
+}
+
+func (w Workload) String() string {
+	return w.Kind + "/" + w.Name
+}
+
+// restartable reports whether the workload runs pods that a rollout restart replaces
+// CronJobs pick up changes with their next job
+func (w Workload) restartable() bool {
+	return w.Kind != "CronJob"
+}
+
+// represents a reference from a workload to a secret
+type SecretRef struct {
+	Workload  Workload
+	Container string // empty for pod level references
+	Secret    string
+	Key       string // empty if all keys of the secret are used
+	Optional  bool
+	Via       string // envFrom, secretKeyRef, volume, imagePullSecrets
+}
+
+// listWorkloads lists the Deployments, StatefulSets, DaemonSets and CronJobs in a namespace
+func (k *kubeClient) listWorkloads(ctx context.Context, namespace string) ([]Workload, error) {
+	remoteNamespace := k.namespace(namespace)
+	var workloads []Workload
+
+	err := k.do(ctx, func(ctx context.Context) error {
+		list, err := k.clientset.AppsV1().Deployments(remoteNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			workloads = append(workloads, Workload{Kind: "Deployment", Name: list.Items[i].Name, Template: &list.Items[i].Spec.Template})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %w", err)
+	}
+
+	err = k.do(ctx, func(ctx context.Context) error {
+		list, err := k.clientset.AppsV1().StatefulSets(remoteNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			workloads = append(workloads, Workload{Kind: "StatefulSet", Name: list.Items[i].Name, Template: &list.Items[i].Spec.Template})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %w", err)
+	}
+
+	err = k.do(ctx, func(ctx context.Context) error {
+		list, err := k.clientset.AppsV1().DaemonSets(remoteNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			workloads = append(workloads, Workload{Kind: "DaemonSet", Name: list.Items[i].Name, Template: &list.Items[i].Spec.Template})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing daemonsets: %w", err)
+	}
+
+	err = k.do(ctx, func(ctx context.Context) error {
+		list, err := k.clientset.BatchV1().CronJobs(remoteNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			workloads = append(workloads, Workload{Kind: "CronJob", Name: list.Items[i].Name, Template: &list.Items[i].Spec.JobTemplate.Spec.Template})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing cronjobs: %w", err)
+	}
+
+	return workloads, nil
+}
+
+// refsBySecret groups the secret references of all workloads by secret name
+func refsBySecret(workloads []Workload) map[string][]SecretRef {
+	refs := make(map[string][]SecretRef)
+	for _, w := range workloads {
+		for _, ref := range secretRefs(w) {
+			refs[ref.Secret] = append(refs[ref.Secret], ref)
+		}
+	}
+	return refs
+}
+
+// secretRefs returns all references to secrets in the pod template of a workload
+// covers envFrom, env secretKeyRef, secret and projected volumes and imagePullSecrets
+func secretRefs(w Workload) []SecretRef {
+	var refs []SecretRef
+	spec := &w.Template.Spec
+
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil {
+				refs = append(refs, SecretRef{
+					Workload:  w,
+					Container: c.Name,
+					Secret:    envFrom.SecretRef.Name,
+					Optional:  isOptional(envFrom.SecretRef.Optional),
+					Via:       "envFrom",
+				})
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				ref := env.ValueFrom.SecretKeyRef
+				refs = append(refs, SecretRef{
+					Workload:  w,
+					Container: c.Name,
+					Secret:    ref.Name,
+					Key:       ref.Key,
+					Optional:  isOptional(ref.Optional),
+					Via:       "secretKeyRef",
+				})
+			}
+		}
+	}
+
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil {
+			refs = append(refs, volumeRefs(w, volume.Secret.SecretName, volume.Secret.Items, isOptional(volume.Secret.Optional))...)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					refs = append(refs, volumeRefs(w, source.Secret.Name, source.Secret.Items, isOptional(source.Secret.Optional))...)
+				}
+			}
+		}
+	}
+
+	for _, pullSecret := range spec.ImagePullSecrets {
+		refs = append(refs, SecretRef{
+			Workload: w,
+			Secret:   pullSecret.Name,
+			Key:      ".dockerconfigjson",
+			Optional: true, // pods start without, pulls of private images fail
+			Via:      "imagePullSecrets",
+		})
+	}
+
+	return refs
+}
+
+// volumeRefs returns the references of a secret volume, one per item or one for all keys
+func volumeRefs(w Workload, secretName string, items []corev1.KeyToPath, optional bool) []SecretRef {
+	if len(items) == 0 {
+		return []SecretRef{{Workload: w, Secret: secretName, Optional: optional, Via: "volume"}}
+	}
+
+	refs := make([]SecretRef, 0, len(items))
+	for _, item := range items {
+		refs = append(refs, SecretRef{Workload: w, Secret: secretName, Key: item.Key, Optional: optional, Via: "volume"})
+	}
+	return refs
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// workloadsToRestart returns the restartable workloads referencing any of the given secrets, in listing order
+func workloadsToRestart(workloads []Workload, secretNames map[string]bool) []Workload {
+	var result []Workload
+	for _, w := range workloads {
+		if !w.restartable() {
+			continue
+		}
+		for _, ref := range secretRefs(w) {
+			if secretNames[ref.Secret] {
+				result = append(result, w)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// restartWorkload triggers a rollout restart like kubectl rollout restart does
+func (k *kubeClient) restartWorkload(ctx context.Context, namespace string, w Workload) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						restartedAtAnnotation: time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error building patch: %w", err)
+	}
+
+	remoteNamespace := k.namespace(namespace)
+	options := metav1.PatchOptions{FieldManager: fieldManager}
+
+	err = k.do(ctx, func(ctx context.Context) error {
+		var err error
+		switch w.Kind {
+		case "Deployment":
+			_, err = k.clientset.AppsV1().Deployments(remoteNamespace).Patch(ctx, w.Name, types.StrategicMergePatchType, patch, options)
+		case "StatefulSet":
+			_, err = k.clientset.AppsV1().StatefulSets(remoteNamespace).Patch(ctx, w.Name, types.StrategicMergePatchType, patch, options)
+		case "DaemonSet":
+			_, err = k.clientset.AppsV1().DaemonSets(remoteNamespace).Patch(ctx, w.Name, types.StrategicMergePatchType, patch, options)
+		default:
+			return fmt.Errorf("cannot restart %s", w.Kind)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error restarting %s: %w", w, err)
+	}
+
+	return nil
+}
+
+// represents a required reference to a secret that an upload would break
+type BrokenRef struct {
+	Namespace string // local namespace
+	Ref       SecretRef
+	Reason    string
+}
+
+func (b BrokenRef) String() string {
+	what := "secret " + b.Ref.Secret
+	if b.Ref.Key != "" {
+		what = "key " + b.Ref.Key + " of " + what
+	}
+	container := ""
+	if b.Ref.Container != "" {
+		container = " container " + b.Ref.Container
+	}
+	return fmt.Sprintf("%s/%s%s needs %s (%s)", b.Namespace, b.Ref.Workload, container, what, b.Reason)
+}
+
+// findBrokenRefs returns the non-optional workload references to removed keys or deleted secrets
+// both maps are keyed by local namespace, then secret name
+func findBrokenRefs(ctx context.Context, kube Kube, removedKeys map[string]map[string][]string, deleted map[string]map[string]bool) ([]BrokenRef, error) {
+	var broken []BrokenRef
+	for _, namespace := range removalNamespaces(removedKeys, deleted) {
+		workloads, err := kube.listWorkloads(ctx, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", kube.namespace(namespace), err)
+		}
+		for _, ref := range brokenRefs(workloads, removedKeys[namespace], deleted[namespace]) {
+			broken = append(broken, BrokenRef{Namespace: namespace, Ref: ref.Ref, Reason: ref.Reason})
+		}
+	}
+
+	return broken, nil
+}
+
+// removalNamespaces returns the sorted local namespaces with removed keys or deleted secrets
+func removalNamespaces(removedKeys map[string]map[string][]string, deleted map[string]map[string]bool) []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	for namespace := range removedKeys {
+		if !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	for namespace := range deleted {
+		if !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+
+	return namespaces
+}
+
+// brokenRefs checks the references of workloads in one namespace against removed keys and deleted secrets
+func brokenRefs(workloads []Workload, removedKeys map[string][]string, deleted map[string]bool) []BrokenRef {
+	var broken []BrokenRef
+	for _, w := range workloads {
+		for _, ref := range secretRefs(w) {
+			if ref.Optional {
+				continue
+			}
+			if deleted[ref.Secret] {
+				broken = append(broken, BrokenRef{Ref: ref, Reason: "secret deleted"})
+				continue
+			}
+			if ref.Key != "" && slices.Contains(removedKeys[ref.Secret], ref.Key) {
+				broken = append(broken, BrokenRef{Ref: ref, Reason: "key removed"})
+			}
+		}
+	}
+	return broken
+}
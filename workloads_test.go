@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSecretRefs(t *testing.T) {
+	optional := true
+	w := Workload{Kind: "Deployment", Name: "api", Template: &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "app",
+				EnvFrom: []corev1.EnvFromSource{{
+					SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env"}},
+				}},
+				Env: []corev1.EnvVar{{
+					Name: "DB_PASS",
+					ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "db"},
+						Key:                  "password",
+						Optional:             &optional,
+					}},
+				}},
+			}},
+			Volumes: []corev1.Volume{
+				{Name: "tls", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "tls"}}},
+				{Name: "projected", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "ca"},
+						Items:                []corev1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+					}}},
+				}}},
+			},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+		},
+	}}
+
+	var got []string
+	for _, ref := range secretRefs(w) {
+		got = append(got, fmt.Sprintf("%s %s %q %q %v", ref.Secret, ref.Via, ref.Key, ref.Container, ref.Optional))
+	}
+
+	want := []string{
+		`env envFrom "" "app" false`,
+		`db secretKeyRef "password" "app" true`,
+		`tls volume "" "" false`,
+		`ca volume "ca.crt" "" false`,
+		`registry imagePullSecrets ".dockerconfigjson" "" true`,
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("secretRefs() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("secretRefs()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWorkloadsToRestart(t *testing.T) {
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+	}}
+	workloads := []Workload{
+		{Kind: "Deployment", Name: "api", Template: template},
+		{Kind: "CronJob", Name: "backup", Template: template},
+		{Kind: "DaemonSet", Name: "agent", Template: &corev1.PodTemplateSpec{}},
+	}
+
+	got := workloadsToRestart(workloads, map[string]bool{"registry": true})
+	if len(got) != 1 || got[0].String() != "Deployment/api" {
+		t.Errorf("workloadsToRestart() = %v, want [Deployment/api]", got)
+	}
+}
+
+func TestBrokenRefs(t *testing.T) {
+	optional := true
+	w := Workload{Kind: "Deployment", Name: "api", Template: &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "app",
+				EnvFrom: []corev1.EnvFromSource{
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "old"}}},
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}}},
+				},
+				Env: []corev1.EnvVar{
+					{Name: "DB_PASS", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "db"},
+						Key:                  "password",
+					}}},
+					{Name: "DB_USER", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "db"},
+						Key:                  "user",
+						Optional:             &optional,
+					}}},
+				},
+			}},
+		},
+	}}
+
+	broken := brokenRefs([]Workload{w}, map[string][]string{"db": {"password", "user"}}, map[string]bool{"old": true})
+
+	var got []string
+	for _, b := range broken {
+		b.Namespace = "test"
+		got = append(got, b.String())
+	}
+
+	want := []string{
+		"test/Deployment/api container app needs secret old (secret deleted)",
+		"test/Deployment/api container app needs key password of secret db (key removed)",
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("brokenRefs() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("brokenRefs()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}